@@ -1,40 +1,71 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/criteo/graphite-writer-stats/input"
 	"github.com/criteo/graphite-writer-stats/prometheus"
 	"github.com/criteo/graphite-writer-stats/stats"
 	"go.uber.org/zap"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	brokers      = flag.String("brokers", "localhost:9092", "Kafka bootstrap brokers to connect to, as a comma separated list")
-	group        = flag.String("group", "", "Kafka consumer group id")
-	topic        = flag.String("topic", "", "Kafka topic to be consumed")
-	oldest       = flag.Bool("oldest", true, "Kafka consumer consume initial offset from oldest")
-	componentsNb = flag.Uint("componentsNb", 3, "number of components per extracted metric path. ex metric path: a.b.c.d with componentsNb=2 => a.b")
-	port         = flag.Uint("port", 8080, "prometheus http endpoint port")
-	endpoint     = flag.String("endpoint", "/metrics", "prometheus http endpoint name")
-	config       = flag.String("config", "configs/rules.json", "rule config path name")
+	inputType      = flag.String("input", "kafka", "input to read datapoints from: kafka, shadow, tcp, udp or pickle")
+	listen         = flag.String("listen", ":2003", "address to listen on for graphite datapoints, with -input tcp, udp or pickle")
+	idleTimeout    = flag.Duration("idleTimeout", 2*time.Minute, "close tcp connections without received data for this duration, 0 to disable")
+	packetSize     = flag.Int("udpPacketSize", 65535, "largest udp packet accepted, larger ones are truncated")
+	queueSize      = flag.Int("udpQueueSize", 10000, "number of udp packets queued for processing, before being dropped")
+	readBuffer     = flag.Int("udpReadBuffer", 0, "size in bytes of the udp socket receive buffer, 0 for the system default")
+	brokers        = flag.String("brokers", "localhost:9092", "Kafka bootstrap brokers to connect to, as a comma separated list")
+	group          = flag.String("group", "", "Kafka consumer group id")
+	topic          = flag.String("topic", "", "Kafka topics to be consumed, as a comma separated list")
+	topicPattern   = flag.String("topicPattern", "", "Kafka topics matching this regular expression are consumed too, including newly created ones")
+	topicRefresh   = flag.Duration("topicRefresh", time.Minute, "interval between two refreshes of the topics matching -topicPattern")
+	topicLabel     = flag.Bool("topicLabel", false, "add the kafka topic as the topic label of metrics_path_total")
+	deadLetter     = flag.String("deadLetterTopic", "", "Kafka topic the rejected datapoints are forwarded to, with -input kafka, none by default")
+	partitions     = flag.String("partitions", "", "partitions of the Kafka topics consumed with -input shadow, as a comma separated list, all by default")
+	shadowStart    = flag.String("shadowStart", "newest", "offsets the partitions are consumed from with -input shadow: newest, oldest, a RFC3339 or unix timestamp, or group:<id> for the offsets committed by a consumer group")
+	workers        = flag.Int("workers", runtime.NumCPU(), "number of workers processing the consumed Kafka messages in parallel, with -input kafka")
+	oldest         = flag.Bool("oldest", true, "Kafka consumer consume initial offset from oldest")
+	componentsNb   = flag.Uint("componentsNb", 3, "number of components per extracted metric path. ex metric path: a.b.c.d with componentsNb=2 => a.b")
+	port           = flag.Uint("port", 8080, "prometheus http endpoint port")
+	endpoint       = flag.String("endpoint", "/metrics", "prometheus http endpoint name")
+	config         = flag.String("config", "configs/rules.json", "rule config path name")
+	format         = flag.String("format", "plain", "format of the datapoints: plain, carbon2, influx, opentsdb, json or auto to detect it for each datapoint")
+	topicFormat    = flag.String("topicFormat", "", "format of the datapoints per kafka topic, overriding -format, as a comma separated list of topic=format")
+	influxTemplate = flag.String("influxTemplate", "measurement.field", "template building the graphite path of influx datapoints, from the measurement, field & tags")
+	futureSkew     = flag.Duration("futureThreshold", 10*time.Minute, "count datapoints with a timestamp further in the future than this duration, 0 to disable")
+	pastSkew       = flag.Duration("pastThreshold", 24*time.Hour, "count datapoints with a timestamp further in the past than this duration, 0 to disable")
+	backfillShare  = flag.Float64("backfillThreshold", 0, "alert on applications whose share of datapoints at least an hour late reaches this value between 0 and 1, 0 to disable")
+	backfillWindow = flag.Duration("backfillWindow", time.Minute, "window the backfill share of applications is computed over")
+	backfillMin    = flag.Uint64("backfillMinDatapoints", 100, "minimum number of datapoints of an application in a backfill window to raise an alert")
+	useTLS         = flag.Bool("tls", false, "connect to Kafka brokers using TLS")
+	tlsCA          = flag.String("tlsCA", "", "PEM file of the CA certificates verifying the Kafka brokers, the system ones by default")
+	tlsCert        = flag.String("tlsCert", "", "PEM file of the client certificate, for Kafka brokers requiring TLS client authentication")
+	tlsKey         = flag.String("tlsKey", "", "PEM file of the client certificate key")
+	tlsServerName  = flag.String("tlsServerName", "", "name used to verify the Kafka brokers certificates, the broker host by default")
+	tlsInsecure    = flag.Bool("tlsInsecureSkipVerify", false, "do not verify the Kafka brokers certificates")
+	saslMechanism  = flag.String("saslMechanism", "", "SASL mechanism used to authenticate to Kafka brokers: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, none by default")
+	saslUser       = flag.String("saslUser", "", "SASL user")
+	saslPassword   = flag.String("saslPassword", os.Getenv("KAFKA_SASL_PASSWORD"), "SASL password, the KAFKA_SASL_PASSWORD environment variable by default")
+	replayStart    = flag.String("replayStart", "", "replay the Kafka messages from this time, as RFC3339 or unix timestamp, write a usage report & exit")
+	replayEnd      = flag.String("replayEnd", "", "replay the Kafka messages until this time, as RFC3339 or unix timestamp, now by default")
+	replayJSON     = flag.String("replayJSON", "replay.json", "path of the json usage report written by a replay, empty to disable")
+	replayCSV      = flag.String("replayCSV", "replay.csv", "path of the csv usage report written by a replay, empty to disable")
 )
 
 func main() {
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
 	flag.Parse()
-	if len(*brokers) == 0 {
-		logger.Fatal("no Kafka bootstrap brokers defined, please set the -brokers flag")
-	}
-	if len(*topic) == 0 {
-		logger.Fatal("no Kafka topic given to be consumed, please set the -topic flag")
-	}
-	if len(*group) == 0 {
-		logger.Fatal("no Kafka consumer group defined, please set the -group flag")
-	}
 	if *componentsNb <= 0 {
 		logger.Fatal("ComponentsNb should be > 0")
 	}
@@ -44,10 +75,47 @@ func main() {
 		logger.Fatal("bad config rule.", zap.String("configFile", *config), zap.Error(err))
 	}
 
-	processor := input.CreateProcessor(logger)
-	err = processor.SetupConsumer(*brokers, *group, *topic, *oldest)
+	datapointFormat, err := stats.ParseFormat(*format)
+	if err != nil {
+		logger.Fatal("bad datapoint format, please set the -format flag", zap.Error(err))
+	}
+
+	topicFormats, err := stats.ParseTopicFormats(*topicFormat)
+	if err != nil {
+		logger.Fatal("bad topic formats, please set the -topicFormat flag", zap.Error(err))
+	}
+
+	pathTemplate, err := stats.ParsePathTemplate(*influxTemplate)
 	if err != nil {
-		logger.Fatal("could not setup consumer: %v", zap.Error(err))
+		logger.Fatal("bad influx path template, please set the -influxTemplate flag", zap.Error(err))
+	}
+
+	security := input.KafkaSecurity{
+		TLS:                *useTLS,
+		CAFile:             *tlsCA,
+		CertFile:           *tlsCert,
+		KeyFile:            *tlsKey,
+		ServerName:         *tlsServerName,
+		InsecureSkipVerify: *tlsInsecure,
+		SASLMechanism:      *saslMechanism,
+		SASLUser:           *saslUser,
+		SASLPassword:       *saslPassword,
+	}
+	var topics []string
+	if len(*topic) > 0 {
+		topics = strings.Split(*topic, ",")
+	}
+
+	var backfill *stats.BackfillTracker
+	if *backfillShare > 0 {
+		backfill, err = stats.NewBackfillTracker(*backfillShare, *backfillWindow, *backfillMin)
+		if err != nil {
+			logger.Fatal("bad backfill detection, please set the -backfillThreshold & -backfillWindow flags", zap.Error(err))
+		}
+	}
+
+	if err := prometheus.SetMetricPathTopicLabel(*topicLabel); err != nil {
+		logger.Fatal("could not register the path counter", zap.Error(err))
 	}
 
 	// Prepare configuration
@@ -56,16 +124,104 @@ func main() {
 			ComponentsNb: *componentsNb,
 			Rules:        rules,
 		},
+		Format:          datapointFormat,
+		TopicFormats:    topicFormats,
+		TopicLabel:      *topicLabel,
+		InfluxTemplate:  pathTemplate,
+		FutureThreshold: *futureSkew,
+		PastThreshold:   *pastSkew,
+		Backfill:        backfill,
 	}
 
-	// Run the Processor using the configuration; This operation will run a goroutine
-	processor.Run(stats)
+	if len(*replayStart) > 0 {
+		replay(logger, stats, topics, security)
+		return
+	}
+
+	var source input.Source
+	switch *inputType {
+	case "kafka":
+		if len(*brokers) == 0 {
+			logger.Fatal("no Kafka bootstrap brokers defined, please set the -brokers flag")
+		}
+		if len(*topic) == 0 && len(*topicPattern) == 0 {
+			logger.Fatal("no Kafka topic given to be consumed, please set the -topic or -topicPattern flag")
+		}
+		if len(*group) == 0 {
+			logger.Fatal("no Kafka consumer group defined, please set the -group flag")
+		}
+		processor := input.CreateProcessor(logger)
+		err = processor.SetupConsumer(*brokers, *group, topics, *topicPattern, *topicRefresh, *oldest, security)
+		if err != nil {
+			logger.Fatal("could not setup consumer: %v", zap.Error(err))
+		}
+		err = processor.SetupWorkers(*workers)
+		if err != nil {
+			logger.Fatal("bad number of workers, please set the -workers flag", zap.Error(err))
+		}
+		if len(*deadLetter) > 0 {
+			err = processor.SetupDeadLetter(*deadLetter)
+			if err != nil {
+				logger.Fatal("could not setup dead-letter producer", zap.Error(err))
+			}
+		}
+		source = processor
+	case "shadow":
+		if len(*topic) == 0 && len(*topicPattern) == 0 {
+			logger.Fatal("no Kafka topic given to be consumed, please set the -topic or -topicPattern flag")
+		}
+		shadowPartitions, err := input.ParsePartitions(*partitions)
+		if err != nil {
+			logger.Fatal("bad partitions, please set the -partitions flag", zap.Error(err))
+		}
+		start, err := input.ParseShadowStart(*shadowStart)
+		if err != nil {
+			logger.Fatal("bad shadow start, please set the -shadowStart flag", zap.Error(err))
+		}
+		processor := input.CreateShadowProcessor(logger)
+		err = processor.SetupConsumer(*brokers, topics, *topicPattern, shadowPartitions, start, security)
+		if err != nil {
+			logger.Fatal("could not setup shadow consumer", zap.Error(err))
+		}
+		source = processor
+	case "tcp":
+		processor := input.CreateTCPProcessor(logger)
+		err = processor.SetupListener(*listen, *idleTimeout)
+		if err != nil {
+			logger.Fatal("could not setup tcp listener", zap.Error(err))
+		}
+		source = processor
+	case "pickle":
+		processor := input.CreatePickleProcessor(logger)
+		err = processor.SetupListener(*listen, *idleTimeout)
+		if err != nil {
+			logger.Fatal("could not setup pickle listener", zap.Error(err))
+		}
+		source = processor
+	case "udp":
+		processor := input.CreateUDPProcessor(logger)
+		err = processor.SetupListener(*listen, *packetSize, *queueSize, *readBuffer)
+		if err != nil {
+			logger.Fatal("could not setup udp listener", zap.Error(err))
+		}
+		source = processor
+	default:
+		logger.Fatal("unknown input, please set the -input flag to kafka, shadow, tcp, udp or pickle", zap.String("input", *inputType))
+	}
+
+	// Run the Source using the configuration; This operation will run a goroutine
+	source.Run(stats)
+
+	// Evaluate the backfill windows even when applications stop sending datapoints
+	if backfill != nil {
+		go backfill.Run(context.Background(), logger)
+	}
 
 	// Start the prometheus endpoint
 	go func() {
 		portBinding := ":" + strconv.Itoa(int(*port))
 		http.Handle(*endpoint, prometheus.GetPrometheusHTTPHandler())
-		http.Handle("/", processor.GetStatusHTTPHandler())
+		http.Handle("/", source.GetStatusHTTPHandler())
 		err := http.ListenAndServe(portBinding, nil)
 		if err != nil {
 			logger.Panic("could not set up HTTP server", zap.Error(err))
@@ -73,6 +229,70 @@ func main() {
 	}()
 
 	// Endless Wait
-	processor.Wait()
-	processor.Close()
+	source.Wait()
+	source.Close()
+}
+
+// replay consumes the Kafka messages between -replayStart & -replayEnd, and writes the usage report of this time window
+func replay(logger *zap.Logger, processor stats.Stats, topics []string, security input.KafkaSecurity) {
+	if len(*topic) == 0 && len(*topicPattern) == 0 {
+		logger.Fatal("no Kafka topic given to be replayed, please set the -topic or -topicPattern flag")
+	}
+	start, err := parseTime(*replayStart)
+	if err != nil {
+		logger.Fatal("bad replay start, please set the -replayStart flag", zap.Error(err))
+	}
+	end := time.Now()
+	if len(*replayEnd) > 0 {
+		end, err = parseTime(*replayEnd)
+		if err != nil {
+			logger.Fatal("bad replay end, please set the -replayEnd flag", zap.Error(err))
+		}
+	}
+
+	job := input.CreateReplayJob(logger)
+	err = job.SetupConsumer(*brokers, topics, *topicPattern, start, end, security)
+	if err != nil {
+		logger.Fatal("could not setup replay", zap.Error(err))
+	}
+	defer job.Close()
+
+	report := stats.NewReport(start, end)
+	processor.Report = report
+	if err = job.Run(processor); err != nil {
+		logger.Fatal("could not replay", zap.Error(err))
+	}
+
+	if len(*replayJSON) > 0 {
+		if err = writeReport(*replayJSON, report.WriteJSON); err != nil {
+			logger.Fatal("could not write json report", zap.String("path", *replayJSON), zap.Error(err))
+		}
+	}
+	if len(*replayCSV) > 0 {
+		if err = writeReport(*replayCSV, report.WriteCSV); err != nil {
+			logger.Fatal("could not write csv report", zap.String("path", *replayCSV), zap.Error(err))
+		}
+	}
+	logger.Info("Replay done", zap.Uint64("datapoints", report.Datapoints()), zap.String("json", *replayJSON), zap.String("csv", *replayCSV))
+}
+
+// parseTime parses a RFC3339 time or a unix timestamp in seconds
+func parseTime(value string) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeReport creates the file at path, and writes the report using the given write function
+func writeReport(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
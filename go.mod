@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/Shopify/sarama v1.23.1
 	github.com/prometheus/client_golang v1.1.0
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.2.0 // indirect
 	go.uber.org/zap v1.10.0
@@ -0,0 +1,102 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// Headers added to the datapoints forwarded to the dead-letter topic, in addition to the original message headers
+const (
+	deadLetterTopicHeader     = "original_topic"
+	deadLetterPartitionHeader = "original_partition"
+	deadLetterOffsetHeader    = "original_offset"
+	deadLetterReasonHeader    = "error_reason"
+	deadLetterErrorHeader     = "error_message"
+)
+
+// DeadLetterProducer forwards the rejected datapoints of consumed messages to a dead-letter topic,
+// with the original topic, partition, offset & the error reason in headers.
+type DeadLetterProducer struct {
+	logger   *zap.Logger
+	topic    string
+	producer sarama.AsyncProducer
+	wg       sync.WaitGroup
+}
+
+// NewDeadLetterProducer creates a DeadLetterProducer to the given topic, using the brokers of the client.
+func NewDeadLetterProducer(logger *zap.Logger, client sarama.Client, topic string) (*DeadLetterProducer, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("can not use empty dead-letter topic")
+	}
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("error creating dead-letter producer: %v", err)
+	}
+	return newDeadLetterProducer(logger, producer, topic), nil
+}
+
+// newDeadLetterProducer creates a DeadLetterProducer using the given producer, and starts reporting its errors
+func newDeadLetterProducer(logger *zap.Logger, producer sarama.AsyncProducer, topic string) *DeadLetterProducer {
+	deadLetter := &DeadLetterProducer{logger: logger, topic: topic, producer: producer}
+
+	deadLetter.wg.Add(1)
+	go func() {
+		defer deadLetter.wg.Done()
+		for err := range producer.Errors() {
+			prometheus.IncDeadLetterErrors()
+			logger.Warn("Error producing to dead-letter topic", zap.String("topic", topic), zap.Error(err))
+		}
+	}()
+
+	return deadLetter
+}
+
+// Forward produces every datapoint of the message rejected with the given error to the dead-letter topic
+func (deadLetter *DeadLetterProducer) Forward(message *sarama.ConsumerMessage, err error) {
+	lines := []stats.LineError{{Line: message.Value, Err: err}}
+	var messageError *stats.MessageError
+	if errors.As(err, &messageError) {
+		lines = messageError.Lines
+	}
+
+	for _, line := range lines {
+		reason := stats.ErrorReason(line.Err)
+		headers := make([]sarama.RecordHeader, 0, len(message.Headers)+5)
+		for _, header := range message.Headers {
+			headers = append(headers, *header)
+		}
+		headers = append(headers,
+			sarama.RecordHeader{Key: []byte(deadLetterTopicHeader), Value: []byte(message.Topic)},
+			sarama.RecordHeader{Key: []byte(deadLetterPartitionHeader), Value: []byte(strconv.Itoa(int(message.Partition)))},
+			sarama.RecordHeader{Key: []byte(deadLetterOffsetHeader), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+			sarama.RecordHeader{Key: []byte(deadLetterReasonHeader), Value: []byte(reason)},
+			sarama.RecordHeader{Key: []byte(deadLetterErrorHeader), Value: []byte(line.Err.Error())},
+		)
+
+		producerMessage := &sarama.ProducerMessage{
+			Topic:     deadLetter.topic,
+			Value:     sarama.ByteEncoder(line.Line),
+			Headers:   headers,
+			Timestamp: message.Timestamp,
+		}
+		if message.Key != nil {
+			producerMessage.Key = sarama.ByteEncoder(message.Key)
+		}
+		deadLetter.producer.Input() <- producerMessage
+		prometheus.IncDeadLetterMessages(reason)
+	}
+}
+
+// Close flushes the datapoints being produced, and closes the producer
+func (deadLetter *DeadLetterProducer) Close() {
+	deadLetter.producer.AsyncClose()
+	deadLetter.wg.Wait()
+}
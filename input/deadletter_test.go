@@ -0,0 +1,62 @@
+package input
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+func TestDeadLetterForward(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(errors.New("broker unavailable"))
+
+	deadLetter := newDeadLetterProducer(zaptest.NewLogger(t), producer, "metrics-dlq")
+
+	message := &sarama.ConsumerMessage{
+		Topic:     "metrics",
+		Partition: 3,
+		Offset:    42,
+		Key:       []byte("host1"),
+		Value:     []byte("foo.bar 1 1500000000\nfoo.baz\nfoo.qux 1 never"),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("app"), Value: []byte("app1")}},
+		Timestamp: time.Unix(1500000000, 0),
+	}
+	processor := stats.Stats{MetricMetadata: stats.MetricMetadata{Rules: stats.Rules{Rules: []stats.Rule{{Name: "all"}}}, ComponentsNb: 3}}
+	err := processor.ProcessMessage(zaptest.NewLogger(t), newDatapoint(message))
+	if err == nil {
+		t.Fatalf("Processing invalid datapoints should fail")
+	}
+	deadLetter.Forward(message, err)
+	deadLetter.Forward(message, errors.New("Empty message"))
+
+	expectedValues := []string{"foo.baz", "foo.qux 1 never"}
+	for _, expectedValue := range expectedValues {
+		produced := <-producer.Successes()
+		value, _ := produced.Value.Encode()
+		key, _ := produced.Key.Encode()
+		if produced.Topic != "metrics-dlq" || string(value) != expectedValue || string(key) != "host1" {
+			t.Errorf("Invalid dead-letter message: %v %q %q", produced.Topic, key, value)
+		}
+
+		headers := make(map[string]string)
+		for _, header := range produced.Headers {
+			headers[string(header.Key)] = string(header.Value)
+		}
+		if headers["app"] != "app1" || headers["original_topic"] != "metrics" || headers["original_partition"] != "3" ||
+			headers["original_offset"] != "42" || headers["error_reason"] == "" || headers["error_message"] == "" {
+			t.Errorf("Invalid dead-letter headers: %v", headers)
+		}
+	}
+
+	deadLetter.Close()
+}
@@ -0,0 +1,61 @@
+package input
+
+import (
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// aggregRule classifies foo.aggreg.<application> paths
+var aggregRule = stats.Rule{Name: "aggreg", Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
+
+// testStats returns the stats of the input tests, counting datapoints in the report if not nil.
+// Datapoints are classified by the given rules, or by their first component without rules.
+func testStats(report *stats.Report, rules ...stats.Rule) stats.Stats {
+	if len(rules) == 0 {
+		rules = []stats.Rule{{Name: "start-by-app"}}
+	}
+	return stats.Stats{
+		MetricMetadata: stats.MetricMetadata{
+			Rules:        stats.Rules{Rules: rules},
+			ComponentsNb: 3,
+		},
+		Report: report,
+	}
+}
+
+// waitDatapoints waits for the report to count the given number of datapoints, or for a second
+func waitDatapoints(report *stats.Report, datapoints uint64) {
+	for i := 0; i < 100 && report.Datapoints() < datapoints; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// gatheredHistogram returns the sample count & sum of an unlabelled histogram, or the value of an unlabelled counter as sum
+func gatheredHistogram(t *testing.T, name string) (uint64, float64) {
+	families, err := promclient.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name || len(family.GetMetric()) == 0 {
+			continue
+		}
+		metric := family.GetMetric()[0]
+		if histogram := metric.GetHistogram(); histogram != nil {
+			return histogram.GetSampleCount(), histogram.GetSampleSum()
+		}
+		return 0, metric.GetCounter().GetValue()
+	}
+	return 0, 0
+}
+
+// gatheredCounter returns the value of an unlabelled counter
+func gatheredCounter(t *testing.T, name string) float64 {
+	_, value := gatheredHistogram(t, name)
+	return value
+}
@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"go.uber.org/zap"
@@ -19,52 +20,83 @@ import (
 )
 
 // KafkaConfiguration stores kafka related configuration
+// topics are always consumed, as well as existing topics matching topicPattern, refreshed every refreshInterval.
 type KafkaConfiguration struct {
-	topics []string
-	group  string
-	config *sarama.Config
-	oldest bool
+	topics          []string
+	topicPattern    *regexp.Regexp
+	refreshInterval time.Duration
+	group           string
+	config          *sarama.Config
+	oldest          bool
+	security        KafkaSecurity
+}
+
+// topicPartition identifies a partition among all consumed topics
+type topicPartition struct {
+	topic     string
+	partition int32
 }
 
 // KafkaProcessor is the entry point to configuring, starting the process & managing metrics
 type KafkaProcessor struct {
-	logger      *zap.Logger
-	kafkaConfig KafkaConfiguration
-	client      sarama.Client
-	consumer    sarama.ConsumerGroup
-	ctx         context.Context
-	cancel      context.CancelFunc
-	wg          *sync.WaitGroup
-	stats       stats.Stats
-	contexts    map[int32]prometheus.PartitionContext
+	logger        *zap.Logger
+	kafkaConfig   KafkaConfiguration
+	client        sarama.Client
+	consumer      sarama.ConsumerGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            *sync.WaitGroup
+	stats         stats.Stats
+	contexts      map[topicPartition]prometheus.PartitionContext
+	mutex         sync.Mutex
+	topics        []string
+	topicsChanged chan struct{}
+	sessionCancel context.CancelFunc
+	deadLetter    *DeadLetterProducer
+	workers       int
+	pipeline      *pipeline
 }
 
 // The BrokerStatus has some broker status informations.
+// Error is the connection error message, AuthenticationFailed is set if it is a TLS or SASL error.
 type BrokerStatus struct {
-	ID              int32
-	Addr            string
-	Rack            string
-	Connected       bool
-	ConnectionError error
+	ID                   int32
+	Addr                 string
+	Rack                 string
+	Connected            bool
+	ConnectionError      error
+	Error                string
+	AuthenticationFailed bool
 }
 
-// The KafkaStatus is the list & statuses of the brokers
+// The KafkaStatus is the list & statuses of the brokers, and the consumed topics
+// TLS & SASLMechanism describe the security in use, AuthenticationFailed is set if any broker failed authentication.
 type KafkaStatus struct {
-	Brokers []BrokerStatus
-	Closed  bool
-	Metrics map[string]map[string]interface{}
+	Brokers              []BrokerStatus
+	Topics               []string
+	Closed               bool
+	TLS                  bool
+	SASLMechanism        string
+	AuthenticationFailed bool
+	Metrics              map[string]map[string]interface{}
 }
 
 // CreateProcessor initialize the main KafkaProcessor structure
+// Messages are processed by one worker per CPU, see SetupWorkers.
 func CreateProcessor(logger *zap.Logger) *KafkaProcessor {
 	return &KafkaProcessor{
-		logger:   logger,
-		contexts: make(map[int32]prometheus.PartitionContext),
+		logger:        logger,
+		workers:       runtime.NumCPU(),
+		contexts:      make(map[topicPartition]prometheus.PartitionContext),
+		topicsChanged: make(chan struct{}, 1),
 	}
 }
 
 // SetupConsumer initializes the sarama client & consumer group, and returns a Processor ready to be used
-func (processor *KafkaProcessor) SetupConsumer(brokers string, group string, topic string, oldest bool) error {
+// The given topics are consumed, as well as the existing ones matching the topicPattern regular expression if not empty:
+// topics are refreshed every refreshInterval, newly created matching topics being consumed without restarting.
+// Brokers are connected to using the TLS & SASL configuration of security.
+func (processor *KafkaProcessor) SetupConsumer(brokers string, group string, topics []string, topicPattern string, refreshInterval time.Duration, oldest bool, security KafkaSecurity) error {
 	var err error
 
 	processor.kafkaConfig.group = group
@@ -74,20 +106,39 @@ func (processor *KafkaProcessor) SetupConsumer(brokers string, group string, top
 	if oldest {
 		config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	}
+	if err = security.apply(config); err != nil {
+		return fmt.Errorf("invalid kafka security configuration: %v", err)
+	}
 
 	processor.kafkaConfig.config = config
+	processor.kafkaConfig.security = security
 
-	if topic == "" {
-		return fmt.Errorf("can not use empty topic")
+	for _, topic := range topics {
+		if topic == "" {
+			return fmt.Errorf("can not use empty topic")
+		}
+	}
+	if len(topics) == 0 && topicPattern == "" {
+		return fmt.Errorf("no topic or topic pattern to consume")
 	}
 
-	processor.kafkaConfig.topics = []string{topic}
+	processor.kafkaConfig.topics = topics
+	if topicPattern != "" {
+		processor.kafkaConfig.topicPattern, err = regexp.Compile(topicPattern)
+		if err != nil {
+			return fmt.Errorf("invalid topic pattern: %v", err)
+		}
+		if refreshInterval <= 0 {
+			return fmt.Errorf("invalid topic refresh interval: %v", refreshInterval)
+		}
+		processor.kafkaConfig.refreshInterval = refreshInterval
+	}
 
 	processor.ctx, processor.cancel = context.WithCancel(context.Background())
 
-	processor.client, err = sarama.NewClient(strings.Split(brokers, ","), config)
+	processor.client, err = newKafkaClient(brokers, config)
 	if err != nil {
-		return fmt.Errorf("error creating kafka client: %v", err)
+		return err
 	}
 
 	processor.consumer, err = sarama.NewConsumerGroupFromClient(group, processor.client)
@@ -95,52 +146,195 @@ func (processor *KafkaProcessor) SetupConsumer(brokers string, group string, top
 		return fmt.Errorf("error creating kafka consumer: %v", err)
 	}
 
+	if _, err = processor.refreshTopics(); err != nil {
+		return fmt.Errorf("error listing kafka topics: %v", err)
+	}
+
 	err = prometheus.RegisterKafkaConsumerMetrics("sarama", processor.kafkaConfig.config)
 	if err != nil {
 		return fmt.Errorf("Fail to register kafka consumer metrics: %v", err)
 	}
 
 	processor.wg = &sync.WaitGroup{}
-	processor.wg.Add(1)
 
 	return nil
 }
 
+// newKafkaClient connects to the comma separated brokers, reporting authentication errors if any.
+func newKafkaClient(brokers string, config *sarama.Config) (sarama.Client, error) {
+	client, err := sarama.NewClient(strings.Split(brokers, ","), config)
+	if err != nil {
+		// sarama only reports that no broker is reachable, look for the underlying authentication error
+		if authErr := probeAuthentication(strings.Split(brokers, ","), config); authErr != nil {
+			return nil, fmt.Errorf("error creating kafka client: %v", authErr)
+		}
+		return nil, fmt.Errorf("error creating kafka client: %v", err)
+	}
+	return client, nil
+}
+
+// listTopics returns the sorted given topics, and the existing ones matching the topic pattern if not nil.
+func listTopics(client sarama.Client, topics []string, topicPattern *regexp.Regexp) ([]string, error) {
+	topics = append([]string(nil), topics...)
+	if topicPattern != nil {
+		if err := client.RefreshMetadata(); err != nil {
+			return nil, err
+		}
+		existingTopics, err := client.Topics()
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range existingTopics {
+			if topicPattern.MatchString(topic) && !containsTopic(topics, topic) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// SetupDeadLetter forwards the rejected datapoints of consumed messages to the given dead-letter topic.
+// It must be called after SetupConsumer, before Run.
+func (processor *KafkaProcessor) SetupDeadLetter(topic string) error {
+	var err error
+	processor.deadLetter, err = NewDeadLetterProducer(processor.logger, processor.client, topic)
+	return err
+}
+
+// SetupWorkers sets the number of workers processing the consumed messages in parallel, for all partitions.
+// It must be called before Run.
+func (processor *KafkaProcessor) SetupWorkers(workers int) error {
+	if workers <= 0 {
+		return fmt.Errorf("invalid number of workers: %v", workers)
+	}
+	processor.workers = workers
+	return nil
+}
+
+// refreshTopics updates the consumed topics with the existing topics matching the topic pattern.
+// It returns true if the consumed topics changed.
+func (processor *KafkaProcessor) refreshTopics() (bool, error) {
+	topics, err := listTopics(processor.client, processor.kafkaConfig.topics, processor.kafkaConfig.topicPattern)
+	if err != nil {
+		return false, err
+	}
+
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+	changed := strings.Join(topics, ",") != strings.Join(processor.topics, ",")
+	processor.topics = topics
+	return changed, nil
+}
+
+func containsTopic(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// watchTopics refreshes the topics matching the topic pattern, and restarts the consumer group session on changes.
+func (processor *KafkaProcessor) watchTopics() {
+	ticker := time.NewTicker(processor.kafkaConfig.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-processor.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := processor.refreshTopics()
+		if err != nil {
+			processor.logger.Warn("Error refreshing kafka topics", zap.Error(err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		processor.mutex.Lock()
+		processor.logger.Info("Consumed kafka topics changed", zap.Strings("topics", processor.topics))
+		if processor.sessionCancel != nil {
+			processor.sessionCancel()
+		}
+		processor.mutex.Unlock()
+
+		select {
+		case processor.topicsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startSession returns the topics to consume & the context of a new consumer group session,
+// cancelled when consumed topics change.
+func (processor *KafkaProcessor) startSession() ([]string, context.Context, context.CancelFunc) {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(processor.ctx)
+	processor.sessionCancel = cancel
+	return processor.topics, ctx, cancel
+}
+
 // Run starts the consumer
 func (processor *KafkaProcessor) Run(stats stats.Stats) {
 	processor.stats = stats
+	processor.pipeline = newPipeline(processor.logger, processor.workers)
+	processor.pipeline.start(stats)
 
+	processor.wg.Add(1)
 	go func() {
 		defer processor.wg.Done()
 		for {
-			if err := processor.consumer.Consume(processor.ctx, processor.kafkaConfig.topics, processor); err != nil {
+			topics, ctx, cancel := processor.startSession()
+			if len(topics) == 0 {
+				processor.logger.Warn("No kafka topic matching, waiting for new topics", zap.String("pattern", processor.kafkaConfig.topicPattern.String()))
+				select {
+				case <-processor.topicsChanged:
+				case <-processor.ctx.Done():
+				}
+			} else if err := processor.consumer.Consume(ctx, topics, processor); err != nil {
 				processor.logger.Panic("Error from consumer", zap.Error(err))
 			}
+			cancel()
+
 			// check if context was cancelled, signaling that the consumer should stop
 			if processor.ctx.Err() != nil {
 				return
 			}
 		}
 	}()
+
+	if processor.kafkaConfig.topicPattern != nil {
+		processor.wg.Add(1)
+		go func() {
+			defer processor.wg.Done()
+			processor.watchTopics()
+		}()
+	}
 }
 
 // Wait endlessly for an unrecoverable error or a INT/TERM stopping signal.
 func (processor *KafkaProcessor) Wait() {
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-
-	select {
-	case <-processor.ctx.Done():
-		processor.logger.Info("terminating: context cancelled")
-	case <-sigterm:
-		processor.logger.Info("terminating: via signal")
-	}
+	waitForTermination(processor.ctx, processor.logger)
 }
 
 // Close the Kafka topic before exiting.
 func (processor *KafkaProcessor) Close() {
 	processor.cancel()
 	processor.wg.Wait()
+	if processor.pipeline != nil {
+		processor.pipeline.close()
+	}
+	if processor.deadLetter != nil {
+		processor.deadLetter.Close()
+	}
 	err := processor.client.Close()
 	if err != nil {
 		processor.logger.Panic("Error closing client: %v", zap.Error(err))
@@ -151,19 +345,20 @@ func (processor *KafkaProcessor) Close() {
 func (processor *KafkaProcessor) Setup(session sarama.ConsumerGroupSession) error {
 
 	// Snapshot assigned partitions
-	currentPartitions := make(map[int32]bool)
+	currentPartitions := make(map[topicPartition]bool)
 	for partition := range processor.contexts {
 		currentPartitions[partition] = true
 	}
 
 	// Create Contexts if required.
-	for _, topic := range processor.kafkaConfig.topics {
-		for _, partition := range session.Claims()[topic] {
-			if _, ok := processor.contexts[partition]; !ok {
-				processor.contexts[partition] = prometheus.NewPartitionContext(partition)
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			key := topicPartition{topic, partition}
+			if _, ok := processor.contexts[key]; !ok {
+				processor.contexts[key] = prometheus.NewPartitionContext(topic, partition)
 			}
 
-			delete(currentPartitions, partition)
+			delete(currentPartitions, key)
 		}
 	}
 
@@ -182,34 +377,82 @@ func (processor *KafkaProcessor) Cleanup(sarama.ConsumerGroupSession) error {
 }
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
+// Messages are processed in parallel by the pipeline workers, their offsets being marked in order once processed.
 func (processor *KafkaProcessor) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
+	partitionContext := processor.contexts[topicPartition{claim.Topic(), claim.Partition()}]
+	processor.pipeline.consume(claim.Messages(), func(message *sarama.ConsumerMessage, err error) {
 		if message.Offset%1000 == 0 {
-			prometheus.MonitorConsumerLag(processor.contexts[claim.Partition()], claim, message)
+			prometheus.MonitorConsumerLag(partitionContext, claim, message)
+		}
+		if err != nil && processor.deadLetter != nil {
+			processor.deadLetter.Forward(message, err)
 		}
-		processor.logger.Debug("Message", zap.ByteString("message", message.Value), zap.Time("timestamp", message.Timestamp), zap.ByteString("key", message.Key))
-		processor.stats.Process(processor.logger, message)
 		session.MarkMessage(message, "")
-	}
+	})
 
 	return nil
 }
 
+// processMessage processes the datapoints of a consumed kafka message, returning the error of the invalid ones
+func processMessage(logger *zap.Logger, processor *stats.Stats, message *sarama.ConsumerMessage) error {
+	err := processor.ProcessMessage(logger, newDatapoint(message))
+	if err != nil {
+		if ce := logger.Check(zap.DebugLevel, "Invalid message"); ce != nil {
+			ce.Write(zap.String("topic", message.Topic), zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Error(err))
+		}
+	}
+	return err
+}
+
+// newDatapoint converts a consumed kafka message to a stats.Datapoint; headers are used as tags.
+func newDatapoint(message *sarama.ConsumerMessage) stats.Datapoint {
+	tags := make(map[string]string, len(message.Headers))
+	for _, kv := range message.Headers {
+		tags[string(kv.Key)] = string(kv.Value)
+	}
+
+	return stats.Datapoint{
+		Value:     message.Value,
+		Tags:      tags,
+		Source:    message.Topic,
+		Timestamp: message.Timestamp,
+		Offset:    message.Offset,
+	}
+}
+
 // Status queries the brokers and fills the KafkaStatus structure
 func (processor *KafkaProcessor) Status() KafkaStatus {
 	status := KafkaStatus{}
-	for _, broker := range processor.client.Brokers() {
+	status.Brokers, status.AuthenticationFailed = brokersStatus(processor.client)
+	processor.mutex.Lock()
+	status.Topics = processor.topics
+	processor.mutex.Unlock()
+	status.Closed = processor.client.Closed()
+	status.TLS = processor.kafkaConfig.security.TLS
+	status.SASLMechanism = processor.kafkaConfig.security.SASLMechanism
+	status.Metrics = processor.kafkaConfig.config.MetricRegistry.GetAll()
+	return status
+}
+
+// brokersStatus queries the brokers of the client, and returns their statuses & whether any authentication failed
+func brokersStatus(client sarama.Client) ([]BrokerStatus, bool) {
+	var statuses []BrokerStatus
+	authenticationFailed := false
+	for _, broker := range client.Brokers() {
 		brokerStatus := BrokerStatus{
 			ID:   broker.ID(),
 			Addr: broker.Addr(),
 			Rack: broker.Rack(),
 		}
 		brokerStatus.Connected, brokerStatus.ConnectionError = broker.Connected()
-		status.Brokers = append(status.Brokers, brokerStatus)
+		if brokerStatus.ConnectionError != nil {
+			brokerStatus.Error = brokerStatus.ConnectionError.Error()
+			brokerStatus.AuthenticationFailed = isAuthenticationError(brokerStatus.ConnectionError)
+			authenticationFailed = authenticationFailed || brokerStatus.AuthenticationFailed
+		}
+		statuses = append(statuses, brokerStatus)
 	}
-	status.Closed = processor.client.Closed()
-	status.Metrics = processor.kafkaConfig.config.MetricRegistry.GetAll()
-	return status
+	return statuses, authenticationFailed
 }
 
 // GetStatusHTTPHandler returns the http handler to query and retrieve the KafkaStatus structure in json format
@@ -0,0 +1,549 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// maxPickleFrameLength is the largest pickle frame accepted, as carbon's MetricPickleReceiver.
+const maxPickleFrameLength = 1 << 20
+
+// CreatePickleProcessor initialize the TCPProcessor structure for the pickle protocol
+// used by carbon-relay & carbon-c-relay.
+func CreatePickleProcessor(logger *zap.Logger) *TCPProcessor {
+	processor := CreateTCPProcessor(logger)
+	processor.read = (*TCPProcessor).readPickleFrames
+	return processor
+}
+
+// readPickleFrames reads length-prefixed pickle frames, each one being a list of (path, (timestamp, value)) tuples.
+func (processor *TCPProcessor) readPickleFrames(logger *zap.Logger, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	var frame []byte
+	for {
+		processor.setIdleDeadline(conn)
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			processor.logReadError(logger, err)
+			return
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		if length > maxPickleFrameLength {
+			logger.Warn("Closing connection sending a too large pickle frame", zap.Uint32("length", length))
+			return
+		}
+
+		if cap(frame) < int(length) {
+			frame = make([]byte, length)
+		}
+		frame = frame[:length]
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			processor.logReadError(logger, err)
+			return
+		}
+
+		metrics, invalid, err := decodePickleMetrics(frame)
+		if err != nil {
+			processor.stats.CountError(&stats.ParseError{Reason: stats.ReasonPickleFrame, Err: err})
+			logger.Warn("Invalid pickle frame", zap.Error(err))
+			continue
+		}
+		for _, err := range invalid {
+			processor.stats.CountError(err)
+		}
+		datapoint := stats.Datapoint{Value: frame, Timestamp: time.Now()}
+		for _, metric := range metrics {
+			processor.stats.ProcessMetric(logger, metric, datapoint)
+		}
+	}
+}
+
+// decodePickleMetrics decodes a pickled list of (path, (timestamp, value)) tuples.
+// It returns the valid metrics and the errors of the invalid tuples.
+func decodePickleMetrics(frame []byte) ([]stats.Metric, []error, error) {
+	value, err := decodePickle(frame)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list, ok := value.(*pickleList)
+	if !ok {
+		return nil, nil, fmt.Errorf("pickle frame is not a list: %T", value)
+	}
+
+	var invalid []error
+	metrics := make([]stats.Metric, 0, len(list.items))
+	for _, item := range list.items {
+		metric, err := pickleItemToMetric(item)
+		if err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, invalid, nil
+}
+
+// pickleItemToMetric converts a (path, (timestamp, value)) tuple to a Metric.
+// Errors are ParseErrors, with the path of the datapoint once known.
+func pickleItemToMetric(item interface{}) (stats.Metric, error) {
+	metric := stats.Metric{Tags: make(map[string]string, 0)}
+
+	fields, ok := pickleSequence(item)
+	if !ok || len(fields) != 2 {
+		return metric, &stats.ParseError{Reason: stats.ReasonPickleDatapoint, Err: fmt.Errorf("datapoint is not a (path, (timestamp, value)) tuple")}
+	}
+	path, ok := fields[0].(string)
+	if !ok || len(path) == 0 {
+		return metric, &stats.ParseError{Reason: stats.ReasonPickleDatapoint, Err: fmt.Errorf("invalid datapoint path")}
+	}
+
+	bareName, err := stats.SplitTaggedPath(path, metric.Tags)
+	if err != nil {
+		return metric, err
+	}
+
+	point, ok := pickleSequence(fields[1])
+	if !ok || len(point) != 2 {
+		return metric, &stats.ParseError{Reason: stats.ReasonPickleDatapoint, Err: fmt.Errorf("datapoint is not a (timestamp, value) tuple"), Path: bareName, Tags: metric.Tags}
+	}
+
+	timestamp, ok := pickleNumber(point[0])
+	if !ok || timestamp < 0 || timestamp > math.MaxUint32 {
+		return metric, &stats.ParseError{Reason: stats.ReasonPickleDatapoint, Err: fmt.Errorf("invalid datapoint timestamp"), Path: bareName, Tags: metric.Tags}
+	}
+	value, ok := pickleNumber(point[1])
+	if !ok {
+		return metric, &stats.ParseError{Reason: stats.ReasonPickleDatapoint, Err: fmt.Errorf("invalid datapoint value"), Path: bareName, Tags: metric.Tags}
+	}
+
+	metric.Path = bareName
+	metric.Timestamp = uint32(timestamp)
+	metric.Value = strconv.FormatFloat(value, 'f', -1, 64)
+
+	return metric, nil
+}
+
+// pickleSequence returns the items of a decoded tuple or list.
+func pickleSequence(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case pickleTuple:
+		return v, true
+	case *pickleList:
+		return v.items, true
+	}
+	return nil, false
+}
+
+// pickleNumber returns the value of a decoded int or float.
+func pickleNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// pickleMark delimits the items of the MARK opcode on the stack.
+type pickleMark struct{}
+
+// pickleList is a decoded list; a pointer is used as lists are modified after being memoized.
+type pickleList struct {
+	items []interface{}
+}
+
+// pickleTuple is a decoded tuple.
+type pickleTuple []interface{}
+
+// pickleDecoder is a restricted unpickler: it only handles the opcodes used to serialize
+// lists, tuples, strings & numbers, as emitted by carbon, and never builds arbitrary objects.
+type pickleDecoder struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// decodePickle decodes a pickled value made of lists, tuples, strings & numbers.
+func decodePickle(data []byte) (interface{}, error) {
+	decoder := pickleDecoder{data: data, memo: make(map[int]interface{})}
+	return decoder.decode()
+}
+
+func (d *pickleDecoder) decode() (interface{}, error) {
+	for {
+		opcode, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode[0] {
+		case '\x80': // PROTO
+			proto, err := d.read(1)
+			if err != nil {
+				return nil, err
+			}
+			if proto[0] > 5 {
+				return nil, fmt.Errorf("unsupported pickle protocol %v", proto[0])
+			}
+		case '\x95': // FRAME
+			if _, err := d.read(8); err != nil {
+				return nil, err
+			}
+		case '.': // STOP
+			value, err := d.pop()
+			if err != nil {
+				return nil, err
+			}
+			if len(d.stack) != 0 {
+				return nil, fmt.Errorf("pickle stack not empty on STOP")
+			}
+			if _, ok := value.(pickleMark); ok {
+				return nil, fmt.Errorf("unexpected MARK on STOP")
+			}
+			return value, nil
+		case '(': // MARK
+			d.push(pickleMark{})
+		case ']': // EMPTY_LIST
+			d.push(&pickleList{})
+		case 'l': // LIST
+			items, err := d.popMark()
+			if err != nil {
+				return nil, err
+			}
+			d.push(&pickleList{items: items})
+		case 'a': // APPEND
+			value, err := d.pop()
+			if err != nil {
+				return nil, err
+			}
+			list, err := d.topList()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, value)
+		case 'e': // APPENDS
+			items, err := d.popMark()
+			if err != nil {
+				return nil, err
+			}
+			list, err := d.topList()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, items...)
+		case ')': // EMPTY_TUPLE
+			d.push(pickleTuple{})
+		case 't': // TUPLE
+			items, err := d.popMark()
+			if err != nil {
+				return nil, err
+			}
+			d.push(pickleTuple(items))
+		case '\x85', '\x86', '\x87': // TUPLE1, TUPLE2, TUPLE3
+			n := int(opcode[0]-'\x85') + 1
+			if len(d.stack) < n {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			items := append(pickleTuple(nil), d.stack[len(d.stack)-n:]...)
+			d.stack = d.stack[:len(d.stack)-n]
+			for _, item := range items {
+				if _, ok := item.(pickleMark); ok {
+					return nil, fmt.Errorf("unexpected MARK in tuple")
+				}
+			}
+			d.push(items)
+		case 'p': // PUT
+			index, err := d.readDecimal()
+			if err != nil {
+				return nil, err
+			}
+			if err := d.put(int(index)); err != nil {
+				return nil, err
+			}
+		case 'q': // BINPUT
+			index, err := d.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.put(int(index)); err != nil {
+				return nil, err
+			}
+		case 'r': // LONG_BINPUT
+			index, err := d.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.put(int(index)); err != nil {
+				return nil, err
+			}
+		case '\x94': // MEMOIZE
+			if err := d.put(len(d.memo)); err != nil {
+				return nil, err
+			}
+		case 'g': // GET
+			index, err := d.readDecimal()
+			if err != nil {
+				return nil, err
+			}
+			if err := d.get(int(index)); err != nil {
+				return nil, err
+			}
+		case 'h': // BINGET
+			index, err := d.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.get(int(index)); err != nil {
+				return nil, err
+			}
+		case 'j': // LONG_BINGET
+			index, err := d.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.get(int(index)); err != nil {
+				return nil, err
+			}
+		case 'N': // NONE
+			d.push(nil)
+		case '\x88': // NEWTRUE
+			d.push(true)
+		case '\x89': // NEWFALSE
+			d.push(false)
+		case 'I': // INT
+			value, err := d.readDecimal()
+			if err != nil {
+				return nil, err
+			}
+			d.push(value)
+		case 'L': // LONG
+			line, err := d.readLine()
+			if err != nil {
+				return nil, err
+			}
+			value, err := strconv.ParseInt(string(bytes.TrimSuffix(line, []byte("L"))), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickle LONG: %v", err)
+			}
+			d.push(value)
+		case 'J': // BININT
+			value, err := d.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			d.push(int64(int32(value)))
+		case 'K': // BININT1
+			value, err := d.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			d.push(int64(value))
+		case 'M': // BININT2
+			value, err := d.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			d.push(int64(value))
+		case '\x8a': // LONG1
+			length, err := d.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readLong(int(length))
+			if err != nil {
+				return nil, err
+			}
+			d.push(value)
+		case 'F': // FLOAT
+			line, err := d.readLine()
+			if err != nil {
+				return nil, err
+			}
+			value, err := strconv.ParseFloat(string(line), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickle FLOAT: %v", err)
+			}
+			d.push(value)
+		case 'G': // BINFLOAT
+			data, err := d.read(8)
+			if err != nil {
+				return nil, err
+			}
+			d.push(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case 'S', 'V': // STRING, UNICODE
+			line, err := d.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if opcode[0] == 'S' {
+				if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+					return nil, fmt.Errorf("invalid pickle STRING quotes")
+				}
+				line = line[1 : len(line)-1]
+			}
+			if bytes.IndexByte(line, '\\') != -1 {
+				return nil, fmt.Errorf("escaped pickle strings are not supported")
+			}
+			d.push(string(line))
+		case 'U', 'C', '\x8c': // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			if err := d.readString(1); err != nil {
+				return nil, err
+			}
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			if err := d.readString(4); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode %#x at position %v", opcode[0], d.pos-1)
+		}
+	}
+}
+
+func (d *pickleDecoder) push(value interface{}) {
+	d.stack = append(d.stack, value)
+}
+
+func (d *pickleDecoder) pop() (interface{}, error) {
+	if len(d.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow")
+	}
+	value := d.stack[len(d.stack)-1]
+	d.stack = d.stack[:len(d.stack)-1]
+	return value, nil
+}
+
+// popMark pops all the items pushed since the last MARK, and the MARK itself.
+func (d *pickleDecoder) popMark() ([]interface{}, error) {
+	for i := len(d.stack) - 1; i >= 0; i-- {
+		if _, ok := d.stack[i].(pickleMark); ok {
+			items := append([]interface{}(nil), d.stack[i+1:]...)
+			d.stack = d.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("pickle MARK not found")
+}
+
+func (d *pickleDecoder) topList() (*pickleList, error) {
+	if len(d.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow")
+	}
+	list, ok := d.stack[len(d.stack)-1].(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("pickle APPEND to a non-list %T", d.stack[len(d.stack)-1])
+	}
+	return list, nil
+}
+
+func (d *pickleDecoder) put(index int) error {
+	if len(d.stack) == 0 {
+		return fmt.Errorf("pickle stack underflow")
+	}
+	d.memo[index] = d.stack[len(d.stack)-1]
+	return nil
+}
+
+func (d *pickleDecoder) get(index int) error {
+	value, ok := d.memo[index]
+	if !ok {
+		return fmt.Errorf("pickle memo %v not found", index)
+	}
+	d.push(value)
+	return nil
+}
+
+func (d *pickleDecoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("truncated pickle data")
+	}
+	data := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return data, nil
+}
+
+// readLine reads up to the next newline, which is consumed but not returned.
+func (d *pickleDecoder) readLine() ([]byte, error) {
+	index := bytes.IndexByte(d.data[d.pos:], '\n')
+	if index == -1 {
+		return nil, fmt.Errorf("truncated pickle data")
+	}
+	line := d.data[d.pos : d.pos+index]
+	d.pos += index + 1
+	return line, nil
+}
+
+func (d *pickleDecoder) readDecimal() (int64, error) {
+	line, err := d.readLine()
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pickle integer: %v", err)
+	}
+	return value, nil
+}
+
+// readUint reads a little-endian unsigned integer of n bytes.
+func (d *pickleDecoder) readUint(n int) (uint64, error) {
+	data, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for i := n - 1; i >= 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, nil
+}
+
+// readLong reads a little-endian two's complement integer of n bytes.
+func (d *pickleDecoder) readLong(n int) (int64, error) {
+	if n > 8 {
+		return 0, fmt.Errorf("pickle LONG1 too large: %v bytes", n)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	value, err := d.readUint(n)
+	if err != nil {
+		return 0, err
+	}
+	// sign extension
+	shift := uint(64 - 8*n)
+	return int64(value<<shift) >> shift, nil
+}
+
+// readString reads a string prefixed by its little-endian length of n bytes.
+func (d *pickleDecoder) readString(n int) error {
+	length, err := d.readUint(n)
+	if err != nil {
+		return err
+	}
+	if length > uint64(len(d.data)-d.pos) {
+		return fmt.Errorf("truncated pickle data")
+	}
+	data, err := d.read(int(length))
+	if err != nil {
+		return err
+	}
+	d.push(string(data))
+	return nil
+}
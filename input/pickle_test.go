@@ -0,0 +1,115 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+func TestDecodePickleMetrics(t *testing.T) {
+	expected := []stats.Metric{
+		{Path: "foo.aggregated.app1.x", Tags: map[string]string{}, Timestamp: 1700000000, Value: "1.5"},
+		{Path: "foo.agglo.app2.y", Tags: map[string]string{}, Timestamp: 1700000000, Value: "42"},
+	}
+	// pickle.dumps([("foo.aggregated.app1.x", (1700000000, 1.5)), ("foo.agglo.app2.y", (1700000000.0, 42))], protocol=N)
+	frames := map[string]string{
+		"protocol 0": "(lp0\n(Vfoo.aggregated.app1.x\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vfoo.agglo.app2.y\np4\n(F1700000000.0\nI42\ntp5\ntp6\na.",
+		"protocol 1": "]q\x00((X\x15\x00\x00\x00foo.aggregated.app1.xq\x01(J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x10\x00\x00\x00foo.agglo.app2.yq\x04(GA\xd9T\xfc@\x00\x00\x00K*tq\x05tq\x06e.",
+		"protocol 2": "\x80\x02]q\x00(X\x15\x00\x00\x00foo.aggregated.app1.xq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x10\x00\x00\x00foo.agglo.app2.yq\x04GA\xd9T\xfc@\x00\x00\x00K*\x86q\x05\x86q\x06e.",
+		"protocol 4": "\x80\x04\x95Q\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x15foo.aggregated.app1.x\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x10foo.agglo.app2.y\x94GA\xd9T\xfc@\x00\x00\x00K*\x86\x94\x86\x94e.",
+		"python2":    "(lp0\n(S'foo.aggregated.app1.x'\np1\n(L1700000000L\nF1.5\ntp2\ntp3\na(S'foo.agglo.app2.y'\np4\n(F1700000000.0\nI42\ntp5\ntp6\na.",
+	}
+
+	for name, frame := range frames {
+		metrics, invalid, err := decodePickleMetrics([]byte(frame))
+		if err != nil || len(invalid) != 0 {
+			t.Errorf("%v: failed to decode frame: %v, invalid: %v", name, err, invalid)
+		}
+		if !reflect.DeepEqual(metrics, expected) {
+			t.Errorf("%v: invalid metrics decoded:\nExp. %v\nGot: %v", name, expected, metrics)
+		}
+	}
+}
+
+func TestDecodePickleInvalid(t *testing.T) {
+	frames := map[string]string{
+		"global":    "cos\nsystem\n(S'echo hi'\ntR.",
+		"reduce":    "\x80\x02]q\x00R.",
+		"truncated": "\x80\x02]q\x00(X\x15\x00\x00\x00foo",
+		"no stop":   "\x80\x02]q\x00",
+		"not list":  "\x80\x02K*.",
+		"bad memo":  "\x80\x02h\x05.",
+		"underflow": "\x80\x02e.",
+	}
+
+	for name, frame := range frames {
+		if _, _, err := decodePickleMetrics([]byte(frame)); err == nil {
+			t.Errorf("%v: decoding frame should fail", name)
+		}
+	}
+}
+
+func TestDecodePickleInvalidDatapoints(t *testing.T) {
+	// [("foo.bar", (1700000000, "nan")), ("foo.baz",), ("", (1, 2)), ("foo.neg", (-1, 2)), ("foo.ok", (1, 2))]
+	frame := "\x80\x02]q\x00(X\x07\x00\x00\x00foo.barJ\x00\xf1SeX\x03\x00\x00\x00nan\x86\x86X\x07\x00\x00\x00foo.baz\x85X\x00\x00\x00\x00K\x01K\x02\x86\x86X\x07\x00\x00\x00foo.negJ\xff\xff\xff\xffK\x02\x86\x86X\x06\x00\x00\x00foo.okK\x01K\x02\x86\x86e."
+	metrics, invalid, err := decodePickleMetrics([]byte(frame))
+	if err != nil {
+		t.Errorf("failed to decode frame: %v", err)
+	}
+	if len(invalid) != 4 || len(metrics) != 1 || metrics[0].Path != "foo.ok" {
+		t.Errorf("invalid datapoints should be skipped: %v invalid, metrics: %v", len(invalid), metrics)
+	}
+	expected := map[string]string{"foo.bar": "pickle_datapoint", "foo.baz": "pickle_datapoint", "": "pickle_datapoint", "foo.neg": "pickle_datapoint"}
+	for _, err := range invalid {
+		var parseError *stats.ParseError
+		if !errors.As(err, &parseError) || expected[parseError.Path] != parseError.Reason {
+			t.Errorf("invalid datapoint error: %#v", err)
+		}
+	}
+}
+
+func TestPickleErrors(t *testing.T) {
+	processor, report := runTCPProcessor(t, CreatePickleProcessor(zaptest.NewLogger(t)), time.Minute)
+	defer processor.Close()
+
+	conn, err := net.Dial("tcp", processor.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// a frame which is not a list, then the frame of TestDecodePickleInvalidDatapoints
+	for _, frame := range []string{
+		"\x80\x02K*.",
+		"\x80\x02]q\x00(X\x07\x00\x00\x00foo.barJ\x00\xf1SeX\x03\x00\x00\x00nan\x86\x86X\x07\x00\x00\x00foo.baz\x85X\x00\x00\x00\x00K\x01K\x02\x86\x86X\x07\x00\x00\x00foo.negJ\xff\xff\xff\xffK\x02\x86\x86X\x06\x00\x00\x00foo.okK\x01K\x02\x86\x86e.",
+	} {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(frame)))
+		conn.Write(append(header, frame...))
+	}
+
+	waitDatapoints(report, 1)
+	var document struct {
+		Errors map[string]uint64 `json:"errors"`
+	}
+	var buffer bytes.Buffer
+	if err := report.WriteJSON(&buffer); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &document); err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	expected := map[string]uint64{"pickle_frame": 1, "pickle_datapoint": 4}
+	if report.Datapoints() != 1 || !reflect.DeepEqual(document.Errors, expected) {
+		t.Errorf("invalid pickle frames & datapoints should be reported: %v datapoints, errors: %v", report.Datapoints(), document.Errors)
+	}
+}
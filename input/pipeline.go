@@ -0,0 +1,102 @@
+package input
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// pipelineDepth is the number of messages per worker queued for processing, or processed & waiting for their offset to be marked
+const pipelineDepth = 64
+
+// batchFlushInterval is the interval between two updates of the prometheus counters by the workers
+const batchFlushInterval = time.Second
+
+// pipelineJob is a consumed message to process; its error, nil if valid, is sent on result once processed
+type pipelineJob struct {
+	message *sarama.ConsumerMessage
+	result  chan error
+}
+
+// pipeline processes the consumed messages of all partitions in parallel, with a pool of workers.
+// Every worker accumulates its counter increments in its own stats.Batch, flushed every batchFlushInterval.
+type pipeline struct {
+	logger  *zap.Logger
+	workers int
+	jobs    chan pipelineJob
+	wg      sync.WaitGroup
+}
+
+// newPipeline initializes a pipeline of the given number of workers
+func newPipeline(logger *zap.Logger, workers int) *pipeline {
+	return &pipeline{
+		logger:  logger,
+		workers: workers,
+		jobs:    make(chan pipelineJob, workers*pipelineDepth),
+	}
+}
+
+// start starts the workers, processing messages with the given stats
+func (pipeline *pipeline) start(processor stats.Stats) {
+	for i := 0; i < pipeline.workers; i++ {
+		pipeline.wg.Add(1)
+		go func() {
+			defer pipeline.wg.Done()
+			pipeline.work(processor)
+		}()
+	}
+}
+
+// work processes messages until the pipeline is closed
+func (pipeline *pipeline) work(processor stats.Stats) {
+	batch := stats.NewBatch()
+	processor = processor.Batched(batch)
+	ticker := time.NewTicker(batchFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case job, ok := <-pipeline.jobs:
+			if !ok {
+				batch.Flush()
+				return
+			}
+			job.result <- processMessage(pipeline.logger, &processor, job.message)
+		case <-ticker.C:
+			batch.Flush()
+		}
+	}
+}
+
+// consume processes the messages of a partition in parallel until the channel is closed,
+// and calls done with every message & its processing error in offset order, from a single goroutine.
+// It returns once done has been called for all messages.
+func (pipeline *pipeline) consume(messages <-chan *sarama.ConsumerMessage, done func(*sarama.ConsumerMessage, error)) {
+	pending := make(chan pipelineJob, pipeline.workers*pipelineDepth)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for job := range pending {
+			done(job.message, <-job.result)
+		}
+	}()
+
+	for message := range messages {
+		job := pipelineJob{message: message, result: make(chan error, 1)}
+		pending <- job
+		pipeline.jobs <- job
+	}
+	close(pending)
+	<-finished
+}
+
+// close stops the workers once all consumed messages are processed, flushing their counters.
+// consume must not be called afterwards.
+func (pipeline *pipeline) close() {
+	close(pipeline.jobs)
+	pipeline.wg.Wait()
+}
@@ -0,0 +1,135 @@
+package input
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// benchmarkLines is the number of datapoints per message of the pipeline benchmark
+const benchmarkLines = 10
+
+func pipelineStats(report *stats.Report) stats.Stats {
+	return testStats(report, aggregRule, stats.Rule{Name: "by-tags", UseTags: []string{"app"}})
+}
+
+// benchmarkMessages returns messages of the given number of datapoints of 50 applications
+func benchmarkMessages(count int, lines int) []*sarama.ConsumerMessage {
+	now := time.Now()
+	messages := make([]*sarama.ConsumerMessage, count)
+	for i := range messages {
+		value := make([]byte, 0, lines*64)
+		for line := 0; line < lines; line++ {
+			value = append(value, fmt.Sprintf("foo.aggreg.app%d.metric%d.count 42 %d\n", (i+line)%50, line, now.Unix())...)
+		}
+		messages[i] = &sarama.ConsumerMessage{Topic: "metrics", Offset: int64(i), Value: value, Timestamp: now}
+	}
+	return messages
+}
+
+// feedMessages sends the messages on the returned channel, closed once they are all sent
+func feedMessages(messages []*sarama.ConsumerMessage) <-chan *sarama.ConsumerMessage {
+	channel := make(chan *sarama.ConsumerMessage, 256)
+	go func() {
+		defer close(channel)
+		for _, message := range messages {
+			channel <- message
+		}
+	}()
+	return channel
+}
+
+// benchmarkLogger is an info level production logger discarding its output
+func benchmarkLogger() *zap.Logger {
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(ioutil.Discard), zap.InfoLevel))
+}
+
+func reportThroughput(b *testing.B, start time.Time, lines int) {
+	b.ReportMetric(float64(b.N*lines)/time.Since(start).Seconds(), "datapoints/s")
+}
+
+func TestPipeline(t *testing.T) {
+	messages := []*sarama.ConsumerMessage{}
+	for offset := int64(0); offset < 500; offset++ {
+		value := fmt.Sprintf("foo.aggreg.app%d.x 1 1500000000\nfoo.aggreg.app%d.y 1 1500000000", offset%7, offset%7)
+		if offset%10 == 3 {
+			value = "invalid"
+		}
+		messages = append(messages, &sarama.ConsumerMessage{Topic: "metrics", Offset: offset, Value: []byte(value)})
+	}
+
+	report := stats.NewReport(time.Time{}, time.Time{})
+	pipeline := newPipeline(zaptest.NewLogger(t), 4)
+	pipeline.start(pipelineStats(report))
+
+	next := int64(0)
+	pipeline.consume(feedMessages(messages), func(message *sarama.ConsumerMessage, err error) {
+		if message.Offset != next {
+			t.Errorf("Messages should be done in offset order, exp. %v got %v", next, message.Offset)
+		}
+		if (err != nil) != (message.Offset%10 == 3) {
+			t.Errorf("Invalid processing error of message %v: %v", message.Offset, err)
+		}
+		next = message.Offset + 1
+	})
+	pipeline.close()
+
+	if next != 500 {
+		t.Errorf("All 500 messages should be done, got %v", next)
+	}
+	if report.Datapoints() != 900 {
+		t.Errorf("900 datapoints should be processed, got %v", report.Datapoints())
+	}
+}
+
+func TestSetupWorkers(t *testing.T) {
+	processor := CreateProcessor(zaptest.NewLogger(t))
+	if processor.workers != runtime.NumCPU() {
+		t.Errorf("Messages should be processed by one worker per CPU by default, got %v", processor.workers)
+	}
+	if err := processor.SetupWorkers(0); err == nil {
+		t.Errorf("Setting up no worker should fail")
+	}
+	if err := processor.SetupWorkers(3); err != nil || processor.workers != 3 {
+		t.Errorf("Failed to setup 3 workers: %v, %v", processor.workers, err)
+	}
+}
+
+// BenchmarkConsumeBaseline processes messages as ConsumeClaim did before the pipeline: one datapoint per message processed inline,
+// with a debug log per message & the prometheus counters incremented for every datapoint.
+// At the baseline commit, the same loop over stats.Process measured 653k datapoints/s on a single core.
+func BenchmarkConsumeBaseline(b *testing.B) {
+	logger := benchmarkLogger()
+	processor := pipelineStats(nil)
+	messages := feedMessages(benchmarkMessages(b.N, 1))
+
+	b.ResetTimer()
+	start := time.Now()
+	for message := range messages {
+		logger.Debug("Message", zap.ByteString("message", message.Value), zap.Time("timestamp", message.Timestamp), zap.ByteString("key", message.Key))
+		processor.Process(logger, newDatapoint(message))
+	}
+	reportThroughput(b, start, 1)
+}
+
+// BenchmarkConsumePipeline processes messages with a pipeline of one worker per core, see the -cpu flag of go test.
+func BenchmarkConsumePipeline(b *testing.B) {
+	pipeline := newPipeline(benchmarkLogger(), runtime.GOMAXPROCS(0))
+	pipeline.start(pipelineStats(nil))
+	messages := feedMessages(benchmarkMessages(b.N, benchmarkLines))
+
+	b.ResetTimer()
+	start := time.Now()
+	pipeline.consume(messages, func(*sarama.ConsumerMessage, error) {})
+	pipeline.close()
+	reportThroughput(b, start, benchmarkLines)
+}
@@ -0,0 +1,213 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// replayIdleTimeout is the time after which a partition without new messages is considered fully replayed,
+// once its high water mark reached the end offset: the remaining offsets are compacted messages or transaction markers.
+const replayIdleTimeout = 10 * time.Second
+
+// ReplayJob consumes once the kafka messages of a time window, without consumer group nor committing offsets.
+type ReplayJob struct {
+	logger   *zap.Logger
+	client   sarama.Client
+	consumer sarama.Consumer
+	topics   []string
+	start    time.Time
+	end      time.Time
+}
+
+// partitionRange is the range of offsets of a partition to replay, from start included to end excluded
+type partitionRange struct {
+	topic     string
+	partition int32
+	start     int64
+	end       int64
+}
+
+// CreateReplayJob initialize the ReplayJob structure
+func CreateReplayJob(logger *zap.Logger) *ReplayJob {
+	return &ReplayJob{logger: logger}
+}
+
+// SetupConsumer initializes the sarama client & consumer, to replay the messages between start & end
+// of the given topics, and of the existing ones matching the topicPattern regular expression if not empty.
+func (job *ReplayJob) SetupConsumer(brokers string, topics []string, topicPattern string, start time.Time, end time.Time, security KafkaSecurity) error {
+	var err error
+	var pattern *regexp.Regexp
+
+	if !start.Before(end) {
+		return fmt.Errorf("replay start %v is not before its end %v", start, end)
+	}
+	job.start, job.end = start, end
+
+	for _, topic := range topics {
+		if topic == "" {
+			return fmt.Errorf("can not use empty topic")
+		}
+	}
+	if len(topics) == 0 && topicPattern == "" {
+		return fmt.Errorf("no topic or topic pattern to replay")
+	}
+	if topicPattern != "" {
+		pattern, err = regexp.Compile(topicPattern)
+		if err != nil {
+			return fmt.Errorf("invalid topic pattern: %v", err)
+		}
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_3_0_0
+	config.Consumer.Return.Errors = true
+	if err = security.apply(config); err != nil {
+		return fmt.Errorf("invalid kafka security configuration: %v", err)
+	}
+
+	job.client, err = newKafkaClient(brokers, config)
+	if err != nil {
+		return err
+	}
+
+	job.topics, err = listTopics(job.client, topics, pattern)
+	if err != nil {
+		return fmt.Errorf("error listing kafka topics: %v", err)
+	}
+
+	job.consumer, err = sarama.NewConsumerFromClient(job.client)
+	if err != nil {
+		return fmt.Errorf("error creating kafka consumer: %v", err)
+	}
+
+	return nil
+}
+
+// resolveOffsets returns the offsets range of every partition of the topics, from the replay start & end timestamps.
+// Partitions without messages in the time window are omitted.
+func (job *ReplayJob) resolveOffsets() ([]partitionRange, error) {
+	var ranges []partitionRange
+	for _, topic := range job.topics {
+		partitions, err := job.client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("error listing partitions of topic %v: %v", topic, err)
+		}
+
+		for _, partition := range partitions {
+			start, err := offsetAt(job.client, topic, partition, job.start)
+			if err != nil {
+				return nil, err
+			}
+			end, err := offsetAt(job.client, topic, partition, job.end)
+			if err != nil {
+				return nil, err
+			}
+			if start < end {
+				ranges = append(ranges, partitionRange{topic, partition, start, end})
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// offsetAt returns the offset of the first message of the partition whose timestamp is at or after the given time,
+// or the high water mark if there is none.
+func offsetAt(client sarama.Client, topic string, partition int32, at time.Time) (int64, error) {
+	offset, err := client.GetOffset(topic, partition, at.UnixNano()/int64(time.Millisecond))
+	if err == nil && offset < 0 {
+		offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error resolving offset of %v/%v at %v: %v", topic, partition, at, err)
+	}
+	return offset, nil
+}
+
+// Run replays the time window, processing messages with the given stats, and returns once every partition is replayed
+// or a INT/TERM stopping signal is received.
+func (job *ReplayJob) Run(stats stats.Stats) error {
+	ranges, err := job.resolveOffsets()
+	if err != nil {
+		return err
+	}
+	job.logger.Info("Replaying kafka messages", zap.Strings("topics", job.topics), zap.Int("partitions", len(ranges)),
+		zap.Time("start", job.start), zap.Time("end", job.end))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		waitForTermination(ctx, job.logger)
+		cancel()
+	}()
+
+	errs := make(chan error, len(ranges))
+	wg := sync.WaitGroup{}
+	for _, offsets := range ranges {
+		wg.Add(1)
+		go func(offsets partitionRange) {
+			defer wg.Done()
+			if err := job.replayPartition(ctx, &stats, offsets); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(offsets)
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// replayPartition processes the messages of the partition range
+func (job *ReplayJob) replayPartition(ctx context.Context, processor *stats.Stats, offsets partitionRange) error {
+	consumer, err := job.consumer.ConsumePartition(offsets.topic, offsets.partition, offsets.start)
+	if err != nil {
+		return fmt.Errorf("error consuming %v/%v: %v", offsets.topic, offsets.partition, err)
+	}
+	defer consumer.AsyncClose()
+
+	idle := time.NewTicker(replayIdleTimeout)
+	defer idle.Stop()
+	received := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-consumer.Errors():
+			job.logger.Warn("Error consuming kafka partition", zap.String("topic", offsets.topic),
+				zap.Int32("partition", offsets.partition), zap.Error(err))
+		case <-idle.C:
+			if !received && consumer.HighWaterMarkOffset() >= offsets.end {
+				return nil
+			}
+			received = false
+		case message := <-consumer.Messages():
+			if message.Offset >= offsets.end {
+				return nil
+			}
+			processMessage(job.logger, processor, message)
+			if message.Offset >= offsets.end-1 {
+				return nil
+			}
+			received = true
+		}
+	}
+}
+
+// Close the kafka consumer & client before exiting.
+func (job *ReplayJob) Close() {
+	if err := job.consumer.Close(); err != nil {
+		job.logger.Warn("Error closing consumer", zap.Error(err))
+	}
+	if err := job.client.Close(); err != nil {
+		job.logger.Warn("Error closing client", zap.Error(err))
+	}
+}
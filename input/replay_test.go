@@ -0,0 +1,77 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+func TestReplayJob(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	end := time.Unix(1500003600, 0)
+	toMillis := func(at time.Time) int64 { return at.UnixNano() / int64(time.Millisecond) }
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	fetchResponse := sarama.NewMockFetchResponse(t, 10).SetVersion(4).SetHighWaterMark("metrics", 0, 15).SetHighWaterMark("metrics", 1, 15)
+	for offset := int64(10); offset < 15; offset++ {
+		fetchResponse.SetMessage("metrics", 0, offset, sarama.StringEncoder("foo.aggreg.app1.x 1 1500000000\nfoo.aggreg.app2.x 1 1500000000"))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("metrics", 0, broker.BrokerID()).
+			SetLeader("metrics", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("metrics", 0, toMillis(start), 11).
+			SetOffset("metrics", 0, toMillis(end), 13).
+			SetOffset("metrics", 0, sarama.OffsetOldest, 10).
+			SetOffset("metrics", 0, sarama.OffsetNewest, 15).
+			SetOffset("metrics", 1, toMillis(start), -1).
+			SetOffset("metrics", 1, toMillis(end), -1).
+			SetOffset("metrics", 1, sarama.OffsetNewest, 15),
+		"FetchRequest": fetchResponse,
+	})
+
+	job := CreateReplayJob(zaptest.NewLogger(t))
+	if err := job.SetupConsumer(broker.Addr(), []string{"metrics"}, "", start, end, KafkaSecurity{}); err != nil {
+		t.Fatalf("Failed to setup replay: %v", err)
+	}
+	defer job.Close()
+
+	ranges, err := job.resolveOffsets()
+	if err != nil {
+		t.Fatalf("Failed to resolve offsets: %v", err)
+	}
+	expectedRanges := []partitionRange{{topic: "metrics", partition: 0, start: 11, end: 13}}
+	if !reflect.DeepEqual(ranges, expectedRanges) {
+		t.Errorf("Invalid offsets ranges:\nExp. %v\nGot: %v", expectedRanges, ranges)
+	}
+
+	report := stats.NewReport(start, end)
+	if err := job.Run(testStats(report, aggregRule)); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+
+	expected := []stats.ReportEntry{
+		{Application: "app1", Rule: "aggreg", Datapoints: 2},
+		{Application: "app2", Rule: "aggreg", Datapoints: 2},
+	}
+	if entries := report.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Invalid replay report:\nExp. %v\nGot: %v", expected, entries)
+	}
+}
+
+func TestReplayJobInvalidWindow(t *testing.T) {
+	job := CreateReplayJob(zaptest.NewLogger(t))
+	now := time.Now()
+	if err := job.SetupConsumer("localhost:9092", []string{"metrics"}, "", now, now.Add(-time.Hour), KafkaSecurity{}); err == nil {
+		t.Errorf("A replay ending before its start should fail")
+	}
+}
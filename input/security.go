@@ -0,0 +1,170 @@
+package input
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// KafkaSecurity stores the kafka TLS & SASL configuration
+// TLS is enabled if TLS is set; CAFile, CertFile & KeyFile are optional PEM files, the system CAs being used by default.
+// ServerName overrides the name used to verify broker certificates, unless InsecureSkipVerify is set.
+// SASL is enabled if SASLMechanism is set: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.
+type KafkaSecurity struct {
+	TLS                bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+	SASLMechanism      string
+	SASLUser           string
+	SASLPassword       string
+}
+
+// apply sets up the TLS & SASL configuration of sarama
+func (security KafkaSecurity) apply(config *sarama.Config) error {
+	if security.TLS {
+		tlsConfig, err := security.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	} else if security.CAFile != "" || security.CertFile != "" || security.KeyFile != "" {
+		return fmt.Errorf("TLS files are given but TLS is not enabled")
+	}
+
+	if security.SASLMechanism == "" {
+		return nil
+	}
+	if security.SASLUser == "" || security.SASLPassword == "" {
+		return fmt.Errorf("SASL user & password are mandatory")
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = security.SASLUser
+	config.Net.SASL.Password = security.SASLPassword
+	switch security.SASLMechanism {
+	case sarama.SASLTypePlaintext:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: sha256.New} }
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: sha512.New} }
+	default:
+		return fmt.Errorf("unsupported SASL mechanism `%v`, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", security.SASLMechanism)
+	}
+
+	return nil
+}
+
+// tlsConfig builds the TLS configuration from the CA & client certificate files
+func (security KafkaSecurity) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         security.ServerName,
+		InsecureSkipVerify: security.InsecureSkipVerify,
+	}
+
+	if security.CAFile != "" {
+		caCert, err := ioutil.ReadFile(security.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in TLS CA file %v", security.CAFile)
+		}
+	}
+
+	if security.CertFile != "" || security.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(security.CertFile, security.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// scramError is an error of the SCRAM exchange, ex: a server signature mismatch
+type scramError struct {
+	err error
+}
+
+func (e *scramError) Error() string {
+	return fmt.Sprintf("SCRAM authentication failed: %v", e.err)
+}
+
+// scramClient implements sarama.SCRAMClient
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+// Begin prepares the client for the SCRAM exchange
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return &scramError{err}
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+// Step steps client through the SCRAM exchange
+func (c *scramClient) Step(challenge string) (string, error) {
+	response, err := c.conversation.Step(challenge)
+	if err != nil {
+		return "", &scramError{err}
+	}
+	return response, nil
+}
+
+// Done should return true when the SCRAM conversation is over
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+// isAuthenticationError returns true for TLS & SASL errors, as opposed to network errors
+func isAuthenticationError(err error) bool {
+	switch err {
+	case sarama.ErrSASLAuthenticationFailed, sarama.ErrUnsupportedSASLMechanism, sarama.ErrIllegalSASLState:
+		return true
+	}
+
+	var scramErr *scramError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	return errors.As(err, &scramErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr) || errors.As(err, &recordHeaderErr)
+}
+
+// probeAuthentication connects to each broker to find out the authentication error preventing the client creation, if any.
+func probeAuthentication(addrs []string, config *sarama.Config) error {
+	for _, addr := range addrs {
+		broker := sarama.NewBroker(addr)
+		if err := broker.Open(config); err != nil {
+			continue
+		}
+		_, err := broker.Connected()
+		broker.Close()
+		if err != nil && isAuthenticationError(err) {
+			return fmt.Errorf("authentication failed on broker %v: %v", addr, err)
+		}
+	}
+	return nil
+}
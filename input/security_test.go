@@ -0,0 +1,87 @@
+package input
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestKafkaSecurityApply(t *testing.T) {
+	config := sarama.NewConfig()
+	if err := (KafkaSecurity{}).apply(config); err != nil || config.Net.TLS.Enable || config.Net.SASL.Enable {
+		t.Errorf("Security should be disabled by default: %v", err)
+	}
+
+	config = sarama.NewConfig()
+	err := KafkaSecurity{TLS: true, ServerName: "kafka", SASLMechanism: "PLAIN", SASLUser: "user", SASLPassword: "secret"}.apply(config)
+	if err != nil {
+		t.Fatalf("Failed to apply TLS & SASL PLAIN: %v", err)
+	}
+	if !config.Net.TLS.Enable || config.Net.TLS.Config.ServerName != "kafka" {
+		t.Errorf("TLS should be enabled: %+v", config.Net.TLS)
+	}
+	if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != sarama.SASLTypePlaintext || config.Net.SASL.User != "user" || config.Net.SASL.Password != "secret" {
+		t.Errorf("SASL PLAIN should be enabled: %+v", config.Net.SASL)
+	}
+
+	for _, mechanism := range []string{sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512} {
+		config = sarama.NewConfig()
+		err = KafkaSecurity{SASLMechanism: mechanism, SASLUser: "user", SASLPassword: "secret"}.apply(config)
+		if err != nil {
+			t.Fatalf("Failed to apply SASL %v: %v", mechanism, err)
+		}
+		if config.Net.SASL.Mechanism != sarama.SASLMechanism(mechanism) || config.Net.SASL.SCRAMClientGeneratorFunc == nil {
+			t.Errorf("SASL %v should be enabled: %+v", mechanism, config.Net.SASL)
+		}
+		client := config.Net.SASL.SCRAMClientGeneratorFunc()
+		if err = client.Begin("user", "secret", ""); err != nil {
+			t.Errorf("Failed to begin %v conversation: %v", mechanism, err)
+		}
+		if _, err = client.Step(""); err != nil || client.Done() {
+			t.Errorf("Failed to start %v conversation: %v", mechanism, err)
+		}
+	}
+	if err = config.Validate(); err != nil {
+		t.Errorf("Invalid sarama configuration: %v", err)
+	}
+}
+
+func TestKafkaSecurityInvalid(t *testing.T) {
+	securities := map[string]KafkaSecurity{
+		"unknown mechanism": {SASLMechanism: "GSSAPI", SASLUser: "user", SASLPassword: "secret"},
+		"missing user":      {SASLMechanism: "PLAIN", SASLPassword: "secret"},
+		"missing password":  {SASLMechanism: "SCRAM-SHA-256", SASLUser: "user"},
+		"TLS disabled":      {CAFile: "ca.pem"},
+		"missing CA":        {TLS: true, CAFile: "/nonexistent/ca.pem"},
+		"missing key":       {TLS: true, CertFile: "/nonexistent/cert.pem"},
+	}
+
+	for name, security := range securities {
+		if err := security.apply(sarama.NewConfig()); err == nil {
+			t.Errorf("%v: invalid security configuration should fail", name)
+		}
+	}
+}
+
+func TestIsAuthenticationError(t *testing.T) {
+	authErrors := []error{
+		sarama.ErrSASLAuthenticationFailed,
+		&scramError{errors.New("server signature mismatch")},
+		fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}),
+		x509.HostnameError{Host: "kafka"},
+	}
+	for _, err := range authErrors {
+		if !isAuthenticationError(err) {
+			t.Errorf("%v should be an authentication error", err)
+		}
+	}
+
+	for _, err := range []error{sarama.ErrOutOfBrokers, errors.New("connection refused")} {
+		if isAuthenticationError(err) {
+			t.Errorf("%v should not be an authentication error", err)
+		}
+	}
+}
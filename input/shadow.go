@@ -0,0 +1,417 @@
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// ShadowStart is the position a ShadowProcessor starts consuming partitions from:
+// Offset (sarama.OffsetNewest or sarama.OffsetOldest), the first message at or after Time if not zero,
+// or the offsets committed by the consumer group Group if not empty.
+type ShadowStart struct {
+	Offset int64
+	Time   time.Time
+	Group  string
+}
+
+// ShadowProcessor consumes kafka partitions directly, without joining a consumer group nor committing offsets.
+type ShadowProcessor struct {
+	logger     *zap.Logger
+	client     sarama.Client
+	consumer   sarama.Consumer
+	config     *sarama.Config
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         *sync.WaitGroup
+	stats      stats.Stats
+	mutex      sync.Mutex
+	offsets    map[topicPartition]int64
+	consumers  map[topicPartition]sarama.PartitionConsumer
+	start      ShadowStart
+	startedAt  map[topicPartition]int64
+	partitions []topicPartition
+}
+
+// ShadowPartitionStatus is the consumed offset & high water mark of a partition
+type ShadowPartitionStatus struct {
+	Topic         string
+	Partition     int32
+	StartOffset   int64
+	Offset        int64
+	HighWaterMark int64
+}
+
+// The ShadowStatus is the list & statuses of the brokers, and the consumed partitions
+type ShadowStatus struct {
+	Brokers              []BrokerStatus
+	Partitions           []ShadowPartitionStatus
+	Closed               bool
+	AuthenticationFailed bool
+	Metrics              map[string]map[string]interface{}
+}
+
+// ParseShadowStart parses the start position of a ShadowProcessor: newest, oldest,
+// a RFC3339 time or unix timestamp, or group:<id> for the committed offsets of a consumer group.
+func ParseShadowStart(value string) (ShadowStart, error) {
+	switch {
+	case value == "newest":
+		return ShadowStart{Offset: sarama.OffsetNewest}, nil
+	case value == "oldest":
+		return ShadowStart{Offset: sarama.OffsetOldest}, nil
+	case strings.HasPrefix(value, "group:"):
+		group := strings.TrimPrefix(value, "group:")
+		if group == "" {
+			return ShadowStart{}, fmt.Errorf("empty consumer group in shadow start `%v`", value)
+		}
+		return ShadowStart{Offset: sarama.OffsetNewest, Group: group}, nil
+	}
+
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ShadowStart{Offset: sarama.OffsetNewest, Time: time.Unix(timestamp, 0)}, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return ShadowStart{}, fmt.Errorf("invalid shadow start `%v`, expected newest, oldest, a time or group:<id>", value)
+	}
+	return ShadowStart{Offset: sarama.OffsetNewest, Time: at}, nil
+}
+
+// ParsePartitions parses a comma separated list of partitions, empty for all partitions
+func ParsePartitions(value string) ([]int32, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var partitions []int32
+	for _, field := range strings.Split(value, ",") {
+		partition, err := strconv.ParseInt(field, 10, 32)
+		if err != nil || partition < 0 {
+			return nil, fmt.Errorf("invalid partition `%v`", field)
+		}
+		partitions = append(partitions, int32(partition))
+	}
+	return partitions, nil
+}
+
+// CreateShadowProcessor initialize the ShadowProcessor structure
+func CreateShadowProcessor(logger *zap.Logger) *ShadowProcessor {
+	return &ShadowProcessor{
+		logger:    logger,
+		offsets:   make(map[topicPartition]int64),
+		consumers: make(map[topicPartition]sarama.PartitionConsumer),
+		startedAt: make(map[topicPartition]int64),
+	}
+}
+
+// SetupConsumer initializes the sarama client & consumer, and resolves the start offset of the consumed partitions:
+// the given partitions, or all of them if empty, of the topics & of the existing ones matching the topicPattern if not empty.
+// Matching topics are listed once, newly created ones are not consumed.
+func (processor *ShadowProcessor) SetupConsumer(brokers string, topics []string, topicPattern string, partitions []int32, start ShadowStart, security KafkaSecurity) error {
+	var err error
+	var pattern *regexp.Regexp
+
+	for _, topic := range topics {
+		if topic == "" {
+			return fmt.Errorf("can not use empty topic")
+		}
+	}
+	if len(topics) == 0 && topicPattern == "" {
+		return fmt.Errorf("no topic or topic pattern to consume")
+	}
+	if topicPattern != "" {
+		pattern, err = regexp.Compile(topicPattern)
+		if err != nil {
+			return fmt.Errorf("invalid topic pattern: %v", err)
+		}
+	}
+
+	processor.config = sarama.NewConfig()
+	processor.config.Version = sarama.V2_3_0_0
+	processor.config.Consumer.Return.Errors = true
+	if err = security.apply(processor.config); err != nil {
+		return fmt.Errorf("invalid kafka security configuration: %v", err)
+	}
+	processor.start = start
+
+	processor.ctx, processor.cancel = context.WithCancel(context.Background())
+
+	processor.client, err = newKafkaClient(brokers, processor.config)
+	if err != nil {
+		return err
+	}
+
+	topics, err = listTopics(processor.client, topics, pattern)
+	if err != nil {
+		return fmt.Errorf("error listing kafka topics: %v", err)
+	}
+	if len(topics) == 0 {
+		return fmt.Errorf("no kafka topic matching %v", topicPattern)
+	}
+
+	processor.partitions, err = processor.assignPartitions(topics, partitions)
+	if err != nil {
+		return err
+	}
+
+	if err = processor.resolveStartOffsets(); err != nil {
+		return err
+	}
+
+	processor.consumer, err = sarama.NewConsumerFromClient(processor.client)
+	if err != nil {
+		return fmt.Errorf("error creating kafka consumer: %v", err)
+	}
+
+	err = prometheus.RegisterKafkaConsumerMetrics("sarama", processor.config)
+	if err != nil {
+		return fmt.Errorf("Fail to register kafka consumer metrics: %v", err)
+	}
+
+	processor.wg = &sync.WaitGroup{}
+
+	return nil
+}
+
+// assignPartitions returns the given partitions of the topics, or all of them if partitions is empty
+func (processor *ShadowProcessor) assignPartitions(topics []string, partitions []int32) ([]topicPartition, error) {
+	var assigned []topicPartition
+	for _, topic := range topics {
+		existingPartitions, err := processor.client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("error listing partitions of topic %v: %v", topic, err)
+		}
+
+		if len(partitions) == 0 {
+			for _, partition := range existingPartitions {
+				assigned = append(assigned, topicPartition{topic, partition})
+			}
+			continue
+		}
+		for _, partition := range partitions {
+			if !containsPartition(existingPartitions, partition) {
+				return nil, fmt.Errorf("topic %v has no partition %v", topic, partition)
+			}
+			assigned = append(assigned, topicPartition{topic, partition})
+		}
+	}
+
+	sort.Slice(assigned, func(i, j int) bool {
+		if assigned[i].topic != assigned[j].topic {
+			return assigned[i].topic < assigned[j].topic
+		}
+		return assigned[i].partition < assigned[j].partition
+	})
+	return assigned, nil
+}
+
+func containsPartition(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveStartOffsets resolves the offset each assigned partition starts from
+func (processor *ShadowProcessor) resolveStartOffsets() error {
+	var committed map[topicPartition]int64
+	var err error
+	if processor.start.Group != "" {
+		committed, err = fetchCommittedOffsets(processor.client, processor.start.Group, processor.partitions)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, partition := range processor.partitions {
+		offset := processor.start.Offset
+		if !processor.start.Time.IsZero() {
+			offset, err = offsetAt(processor.client, partition.topic, partition.partition, processor.start.Time)
+			if err != nil {
+				return err
+			}
+		} else if processor.start.Group != "" {
+			if groupOffset, ok := committed[partition]; ok {
+				offset = groupOffset
+			} else {
+				processor.logger.Warn("No committed offset, consuming from newest", zap.String("group", processor.start.Group),
+					zap.String("topic", partition.topic), zap.Int32("partition", partition.partition))
+			}
+		}
+		processor.startedAt[partition] = offset
+	}
+	return nil
+}
+
+// fetchCommittedOffsets returns the offsets committed by the consumer group, without joining it.
+// Partitions without committed offset are omitted.
+func fetchCommittedOffsets(client sarama.Client, group string, partitions []topicPartition) (map[topicPartition]int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the coordinator of consumer group %v: %v", group, err)
+	}
+
+	request := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for _, partition := range partitions {
+		request.AddPartition(partition.topic, partition.partition)
+	}
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the offsets of consumer group %v: %v", group, err)
+	}
+
+	offsets := make(map[topicPartition]int64)
+	for _, partition := range partitions {
+		block := response.GetBlock(partition.topic, partition.partition)
+		if block == nil {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("error fetching the offset of consumer group %v on %v/%v: %v", group, partition.topic, partition.partition, block.Err)
+		}
+		if block.Offset >= 0 {
+			offsets[partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// Run starts consuming every assigned partition.
+// A partition which can not be consumed stops the processor, as an unrecoverable error.
+func (processor *ShadowProcessor) Run(stats stats.Stats) {
+	processor.stats = stats
+
+	for _, partition := range processor.partitions {
+		consumer, err := processor.consumePartitionFrom(partition)
+		if err != nil {
+			processor.logger.Error("Error consuming partition", zap.String("topic", partition.topic), zap.Int32("partition", partition.partition), zap.Error(err))
+			processor.cancel()
+			return
+		}
+		partitionContext := prometheus.NewPartitionContext(partition.topic, partition.partition)
+		processor.mutex.Lock()
+		processor.consumers[partition] = consumer
+		processor.mutex.Unlock()
+
+		processor.wg.Add(1)
+		go func(partition topicPartition, consumer sarama.PartitionConsumer, partitionContext prometheus.PartitionContext) {
+			defer processor.wg.Done()
+			processor.consumePartition(partition, consumer, partitionContext)
+		}(partition, consumer, partitionContext)
+	}
+	processor.logger.Info("Shadow consuming kafka partitions", zap.Int("partitions", len(processor.partitions)))
+}
+
+// consumePartitionFrom starts consuming a partition from its start offset.
+// A start offset no longer available, such as an expired committed offset, falls back to the newest offset.
+func (processor *ShadowProcessor) consumePartitionFrom(partition topicPartition) (sarama.PartitionConsumer, error) {
+	consumer, err := processor.consumer.ConsumePartition(partition.topic, partition.partition, processor.startedAt[partition])
+	if err != sarama.ErrOffsetOutOfRange {
+		return consumer, err
+	}
+
+	newest, err := processor.client.GetOffset(partition.topic, partition.partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the newest offset: %v", err)
+	}
+	processor.logger.Warn("Start offset out of range, consuming from newest", zap.String("topic", partition.topic),
+		zap.Int32("partition", partition.partition), zap.Int64("offset", processor.startedAt[partition]), zap.Int64("newest", newest))
+	processor.mutex.Lock()
+	processor.startedAt[partition] = newest
+	processor.mutex.Unlock()
+	return processor.consumer.ConsumePartition(partition.topic, partition.partition, newest)
+}
+
+// consumePartition processes the messages of a partition until the processor is closed
+func (processor *ShadowProcessor) consumePartition(partition topicPartition, consumer sarama.PartitionConsumer, partitionContext prometheus.PartitionContext) {
+	defer consumer.AsyncClose()
+
+	for {
+		select {
+		case <-processor.ctx.Done():
+			return
+		case err := <-consumer.Errors():
+			processor.logger.Warn("Error consuming kafka partition", zap.String("topic", partition.topic),
+				zap.Int32("partition", partition.partition), zap.Error(err))
+		case message := <-consumer.Messages():
+			if message.Offset%1000 == 0 {
+				prometheus.MonitorConsumerLag(partitionContext, consumer, message)
+			}
+			processMessage(processor.logger, &processor.stats, message)
+
+			processor.mutex.Lock()
+			processor.offsets[partition] = message.Offset + 1
+			processor.mutex.Unlock()
+		}
+	}
+}
+
+// Wait endlessly for an unrecoverable error or a INT/TERM stopping signal.
+func (processor *ShadowProcessor) Wait() {
+	waitForTermination(processor.ctx, processor.logger)
+}
+
+// Close the partition consumers before exiting.
+func (processor *ShadowProcessor) Close() {
+	processor.cancel()
+	processor.wg.Wait()
+	if err := processor.consumer.Close(); err != nil {
+		processor.logger.Warn("Error closing consumer", zap.Error(err))
+	}
+	err := processor.client.Close()
+	if err != nil {
+		processor.logger.Panic("Error closing client: %v", zap.Error(err))
+	}
+}
+
+// Status queries the brokers and fills the ShadowStatus structure
+func (processor *ShadowProcessor) Status() ShadowStatus {
+	status := ShadowStatus{}
+	status.Brokers, status.AuthenticationFailed = brokersStatus(processor.client)
+
+	processor.mutex.Lock()
+	for _, partition := range processor.partitions {
+		partitionStatus := ShadowPartitionStatus{
+			Topic:       partition.topic,
+			Partition:   partition.partition,
+			StartOffset: processor.startedAt[partition],
+			Offset:      processor.offsets[partition],
+		}
+		if consumer, ok := processor.consumers[partition]; ok {
+			partitionStatus.HighWaterMark = consumer.HighWaterMarkOffset()
+		}
+		status.Partitions = append(status.Partitions, partitionStatus)
+	}
+	processor.mutex.Unlock()
+
+	status.Closed = processor.client.Closed()
+	status.Metrics = processor.config.MetricRegistry.GetAll()
+	return status
+}
+
+// GetStatusHTTPHandler returns the http handler to query and retrieve the ShadowStatus structure in json format
+func (processor *ShadowProcessor) GetStatusHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.MarshalIndent(processor.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(bytes)
+	})
+}
@@ -0,0 +1,148 @@
+package input
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+func TestParseShadowStart(t *testing.T) {
+	starts := map[string]ShadowStart{
+		"newest":               {Offset: sarama.OffsetNewest},
+		"oldest":               {Offset: sarama.OffsetOldest},
+		"group:graphite":       {Offset: sarama.OffsetNewest, Group: "graphite"},
+		"1500000000":           {Offset: sarama.OffsetNewest, Time: time.Unix(1500000000, 0)},
+		"2017-07-14T02:40:00Z": {Offset: sarama.OffsetNewest, Time: time.Unix(1500000000, 0).UTC()},
+	}
+	for value, expected := range starts {
+		start, err := ParseShadowStart(value)
+		if err != nil || !reflect.DeepEqual(start, expected) {
+			t.Errorf("Invalid shadow start parsed from %v: %v, %v", value, start, err)
+		}
+	}
+
+	for _, value := range []string{"", "latest", "group:", "2017-07-14"} {
+		if _, err := ParseShadowStart(value); err == nil {
+			t.Errorf("Parsing shadow start `%v` should fail", value)
+		}
+	}
+}
+
+func TestParsePartitions(t *testing.T) {
+	partitions, err := ParsePartitions("0,2,5")
+	if err != nil || !reflect.DeepEqual(partitions, []int32{0, 2, 5}) {
+		t.Errorf("Invalid partitions parsed: %v, %v", partitions, err)
+	}
+	if partitions, err = ParsePartitions(""); err != nil || partitions != nil {
+		t.Errorf("Empty partitions should be parsed as all partitions: %v, %v", partitions, err)
+	}
+	for _, value := range []string{"a", "1,", "-1"} {
+		if _, err := ParsePartitions(value); err == nil {
+			t.Errorf("Parsing partitions `%v` should fail", value)
+		}
+	}
+}
+
+func TestShadowProcessor(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	fetchResponse := sarama.NewMockFetchResponse(t, 10).SetVersion(4).SetHighWaterMark("metrics", 1, 13)
+	for offset := int64(10); offset < 13; offset++ {
+		fetchResponse.SetMessage("metrics", 1, offset, sarama.StringEncoder("foo.aggreg.app1.x 1 1500000000"))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("metrics", 0, broker.BrokerID()).
+			SetLeader("metrics", 1, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, "graphite", broker),
+		"OffsetFetchRequest":     sarama.NewMockOffsetFetchResponse(t).SetOffset("graphite", "metrics", 1, 11, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("metrics", 1, sarama.OffsetOldest, 10).
+			SetOffset("metrics", 1, sarama.OffsetNewest, 13),
+		"FetchRequest": fetchResponse,
+	})
+
+	processor := CreateShadowProcessor(zaptest.NewLogger(t))
+	if err := processor.SetupConsumer(broker.Addr(), []string{"metrics"}, "", []int32{2}, ShadowStart{Offset: sarama.OffsetNewest}, KafkaSecurity{}); err == nil {
+		t.Errorf("Consuming a missing partition should fail")
+	}
+
+	processor = CreateShadowProcessor(zaptest.NewLogger(t))
+	err := processor.SetupConsumer(broker.Addr(), []string{"metrics"}, "", []int32{1}, ShadowStart{Offset: sarama.OffsetNewest, Group: "graphite"}, KafkaSecurity{})
+	if err != nil {
+		t.Fatalf("Failed to setup shadow consumer: %v", err)
+	}
+	if processor.startedAt[topicPartition{"metrics", 1}] != 11 {
+		t.Errorf("Consumption should start from the committed offset 11, got %v", processor.startedAt)
+	}
+
+	report := stats.NewReport(time.Time{}, time.Time{})
+	processor.Run(testStats(report, aggregRule))
+	waitDatapoints(report, 2)
+	processor.Close()
+
+	if report.Datapoints() != 2 {
+		t.Errorf("The 2 messages after the committed offset should be consumed, got %v", report.Datapoints())
+	}
+	status := processor.Status()
+	if len(status.Partitions) != 1 || status.Partitions[0].StartOffset != 11 || status.Partitions[0].Offset != 13 {
+		t.Errorf("Invalid shadow status: %+v", status.Partitions)
+	}
+}
+
+func TestShadowProcessorExpiredOffset(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("metrics", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, "graphite", broker),
+		// the committed offset 5 was deleted by the retention
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).SetOffset("graphite", "metrics", 0, 5, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("metrics", 0, sarama.OffsetOldest, 10).
+			SetOffset("metrics", 0, sarama.OffsetNewest, 13),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(4).SetHighWaterMark("metrics", 0, 13),
+	})
+
+	// the consumer is set up by hand, the kafka metrics being already registered by TestShadowProcessor
+	processor := CreateShadowProcessor(zaptest.NewLogger(t))
+	processor.config = sarama.NewConfig()
+	processor.config.Version = sarama.V2_3_0_0
+	processor.ctx, processor.cancel = context.WithCancel(context.Background())
+	processor.wg = &sync.WaitGroup{}
+	processor.start = ShadowStart{Offset: sarama.OffsetNewest, Group: "graphite"}
+	processor.partitions = []topicPartition{{"metrics", 0}}
+	var err error
+	if processor.client, err = newKafkaClient(broker.Addr(), processor.config); err != nil {
+		t.Fatalf("Failed to create kafka client: %v", err)
+	}
+	if err = processor.resolveStartOffsets(); err != nil || processor.startedAt[topicPartition{"metrics", 0}] != 5 {
+		t.Fatalf("Consumption should start from the committed offset 5, got %v, %v", processor.startedAt, err)
+	}
+	if processor.consumer, err = sarama.NewConsumerFromClient(processor.client); err != nil {
+		t.Fatalf("Failed to create kafka consumer: %v", err)
+	}
+
+	processor.Run(testStats(nil))
+	if processor.ctx.Err() != nil {
+		t.Errorf("An out of range committed offset should not stop the processor")
+	}
+	processor.Close()
+
+	status := processor.Status()
+	if len(status.Partitions) != 1 || status.Partitions[0].StartOffset != 13 {
+		t.Errorf("Consumption should fall back to the newest offset 13: %+v", status.Partitions)
+	}
+}
@@ -0,0 +1,55 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// Source is an input feeding received datapoints to stats.Stats; the kafka consumer is one of them.
+type Source interface {
+	// Run starts consuming the input in background, processing datapoints with the given stats.
+	Run(stats stats.Stats)
+	// Wait endlessly for an unrecoverable error or a INT/TERM stopping signal.
+	Wait()
+	// Close the input before exiting.
+	Close()
+	// GetStatusHTTPHandler returns the http handler exposing the input status.
+	GetStatusHTTPHandler() http.Handler
+}
+
+// waitForTermination blocks until the given context is cancelled or a INT/TERM signal is received.
+func waitForTermination(ctx context.Context, logger *zap.Logger) {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-ctx.Done():
+		logger.Info("terminating: context cancelled")
+	case <-sigterm:
+		logger.Info("terminating: via signal")
+	}
+}
+
+// processLine feeds a single plaintext line to stats.
+func processLine(logger *zap.Logger, processor *stats.Stats, line []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return
+	}
+
+	datapoint := stats.Datapoint{Value: line, Timestamp: time.Now()}
+	if err := processor.Process(logger, datapoint); err != nil {
+		if ce := logger.Check(zap.DebugLevel, "Invalid datapoint"); ce != nil {
+			ce.Write(zap.ByteString("line", line), zap.Error(err))
+		}
+	}
+}
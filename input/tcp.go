@@ -0,0 +1,225 @@
+package input
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// maxLineLength is the longest plaintext line accepted; longer lines are discarded.
+const maxLineLength = 64 * 1024
+
+// TCPProcessor listens for graphite datapoints on a TCP port, either in the plaintext or the pickle protocol
+type TCPProcessor struct {
+	logger      *zap.Logger
+	listener    net.Listener
+	read        func(processor *TCPProcessor, logger *zap.Logger, conn net.Conn)
+	idleTimeout time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          *sync.WaitGroup
+	stats       stats.Stats
+	mutex       sync.Mutex
+	connections map[net.Conn]struct{}
+	accepted    uint64
+}
+
+// The TCPStatus is the state of the listener & its connections
+type TCPStatus struct {
+	Address             string
+	ActiveConnections   int
+	AcceptedConnections uint64
+	Closed              bool
+}
+
+// CreateTCPProcessor initialize the TCPProcessor structure for the plaintext protocol
+func CreateTCPProcessor(logger *zap.Logger) *TCPProcessor {
+	return &TCPProcessor{
+		logger:      logger,
+		read:        (*TCPProcessor).readLines,
+		connections: make(map[net.Conn]struct{}),
+	}
+}
+
+// SetupListener binds the TCP listener on the given address.
+// Connections without any received data during idleTimeout are closed; 0 disables the timeout.
+func (processor *TCPProcessor) SetupListener(address string, idleTimeout time.Duration) error {
+	var err error
+
+	processor.idleTimeout = idleTimeout
+	processor.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %v: %v", address, err)
+	}
+
+	processor.ctx, processor.cancel = context.WithCancel(context.Background())
+	processor.wg = &sync.WaitGroup{}
+
+	return nil
+}
+
+// Run starts accepting connections
+func (processor *TCPProcessor) Run(stats stats.Stats) {
+	processor.stats = stats
+
+	processor.wg.Add(1)
+	go func() {
+		defer processor.wg.Done()
+		for {
+			conn, err := processor.listener.Accept()
+			if err != nil {
+				// check if context was cancelled, signaling that the listener should stop
+				if processor.ctx.Err() != nil {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					processor.logger.Warn("Error accepting connection", zap.Error(err))
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				processor.logger.Error("Error from listener", zap.Error(err))
+				processor.cancel()
+				return
+			}
+
+			if !processor.track(conn) {
+				conn.Close()
+				return
+			}
+			processor.wg.Add(1)
+			go processor.handleConnection(conn)
+		}
+	}()
+}
+
+// track registers a new connection, to be closed on exit; it returns false if the processor is already closing.
+func (processor *TCPProcessor) track(conn net.Conn) bool {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+	if processor.ctx.Err() != nil {
+		return false
+	}
+	processor.connections[conn] = struct{}{}
+	processor.accepted++
+	return true
+}
+
+// untrack unregisters & closes a connection.
+func (processor *TCPProcessor) untrack(conn net.Conn) {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+	delete(processor.connections, conn)
+	conn.Close()
+}
+
+// handleConnection reads datapoints until the connection is closed or idle.
+func (processor *TCPProcessor) handleConnection(conn net.Conn) {
+	defer processor.wg.Done()
+	defer processor.untrack(conn)
+
+	logger := processor.logger.With(zap.String("remote", conn.RemoteAddr().String()))
+	processor.read(processor, logger, conn)
+}
+
+// setIdleDeadline sets the read deadline of the connection, if an idle timeout is configured.
+func (processor *TCPProcessor) setIdleDeadline(conn net.Conn) {
+	if processor.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(processor.idleTimeout))
+	}
+}
+
+// logReadError logs the error ending a connection, unless it is a regular close.
+func (processor *TCPProcessor) logReadError(logger *zap.Logger, err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		logger.Info("Closing idle connection")
+	} else if err != io.EOF && processor.ctx.Err() == nil {
+		logger.Warn("Error reading connection", zap.Error(err))
+	}
+}
+
+// readLines reads newline separated plaintext datapoints.
+func (processor *TCPProcessor) readLines(logger *zap.Logger, conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxLineLength)
+	discarding := false
+	for {
+		processor.setIdleDeadline(conn)
+
+		line, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			// a partial line is only processed when the peer closes the connection
+			if err == io.EOF && len(line) > 0 && !discarding {
+				processLine(logger, &processor.stats, line)
+			}
+			processor.logReadError(logger, err)
+			return
+		}
+		if err == bufio.ErrBufferFull {
+			if !discarding {
+				logger.Warn("Discarding too long line", zap.ByteString("start", line[:64]))
+			}
+			discarding = true
+			continue
+		}
+		if discarding {
+			// end of a too long line
+			discarding = false
+			continue
+		}
+
+		processLine(logger, &processor.stats, line)
+	}
+}
+
+// Wait endlessly for an unrecoverable error or a INT/TERM stopping signal.
+func (processor *TCPProcessor) Wait() {
+	waitForTermination(processor.ctx, processor.logger)
+}
+
+// Close the listener & all active connections before exiting.
+func (processor *TCPProcessor) Close() {
+	processor.mutex.Lock()
+	processor.cancel()
+	processor.listener.Close()
+
+	for conn := range processor.connections {
+		conn.Close()
+	}
+	processor.mutex.Unlock()
+
+	processor.wg.Wait()
+}
+
+// Status fills the TCPStatus structure
+func (processor *TCPProcessor) Status() TCPStatus {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+
+	return TCPStatus{
+		Address:             processor.listener.Addr().String(),
+		ActiveConnections:   len(processor.connections),
+		AcceptedConnections: processor.accepted,
+		Closed:              processor.ctx.Err() != nil,
+	}
+}
+
+// GetStatusHTTPHandler returns the http handler to query and retrieve the TCPStatus structure in json format
+func (processor *TCPProcessor) GetStatusHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, err := json.MarshalIndent(processor.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(content)
+	})
+}
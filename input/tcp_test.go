@@ -0,0 +1,164 @@
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// startTCPProcessor runs a plaintext TCPProcessor on a random local port, counting datapoints in the returned report
+func startTCPProcessor(t *testing.T, idleTimeout time.Duration) (*TCPProcessor, *stats.Report) {
+	return runTCPProcessor(t, CreateTCPProcessor(zaptest.NewLogger(t)), idleTimeout)
+}
+
+// runTCPProcessor runs the given TCPProcessor on a random local port, counting datapoints in the returned report
+func runTCPProcessor(t *testing.T, processor *TCPProcessor, idleTimeout time.Duration) (*TCPProcessor, *stats.Report) {
+	if err := processor.SetupListener("127.0.0.1:0", idleTimeout); err != nil {
+		t.Fatalf("Failed to setup tcp listener: %v", err)
+	}
+
+	report := stats.NewReport(time.Time{}, time.Time{})
+	processor.Run(testStats(report))
+	return processor, report
+}
+
+// readTrackingConn counts the bytes read from a connection, and whether a read is blocked waiting for more
+type readTrackingConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	read    int
+	reading bool
+}
+
+func (conn *readTrackingConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	conn.reading = true
+	conn.mutex.Unlock()
+
+	n, err := conn.Conn.Read(b)
+
+	conn.mutex.Lock()
+	conn.reading = false
+	conn.read += n
+	conn.mutex.Unlock()
+	return n, err
+}
+
+// waitReading waits for the connection to be read again once the given number of bytes are read, or for a second
+func (conn *readTrackingConn) waitReading(read int) bool {
+	for i := 0; i < 1000; i++ {
+		conn.mutex.Lock()
+		done := conn.reading && conn.read == read
+		conn.mutex.Unlock()
+		if done {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestTCPConcurrentConnections(t *testing.T) {
+	processor, report := startTCPProcessor(t, time.Minute)
+	defer processor.Close()
+
+	var wg sync.WaitGroup
+	for client := 0; client < 10; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", processor.listener.Addr().String())
+			if err != nil {
+				t.Errorf("Failed to connect: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			for line := 0; line < 100; line++ {
+				fmt.Fprintf(conn, "app%d.x.y %d 1500000000\n", client, line)
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	waitDatapoints(report, 1000)
+	if report.Datapoints() != 1000 {
+		t.Errorf("1000 datapoints should be processed, got %v", report.Datapoints())
+	}
+	if status := processor.Status(); status.AcceptedConnections != 10 {
+		t.Errorf("10 connections should be accepted, got %v", status.AcceptedConnections)
+	}
+}
+
+func TestTCPPartialLine(t *testing.T) {
+	tracked := make(chan *readTrackingConn, 1)
+	processor := CreateTCPProcessor(zaptest.NewLogger(t))
+	processor.read = func(processor *TCPProcessor, logger *zap.Logger, conn net.Conn) {
+		trackingConn := &readTrackingConn{Conn: conn}
+		tracked <- trackingConn
+		processor.readLines(logger, trackingConn)
+	}
+	processor, report := runTCPProcessor(t, processor, time.Minute)
+	defer processor.Close()
+
+	conn, err := net.Dial("tcp", processor.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	sent := []byte("app1.x.y 1 1500000000\napp2.x.y 1 15000")
+	conn.Write(sent)
+	// the whole partial line is received once the connection is read again
+	if !(<-tracked).waitReading(len(sent)) {
+		t.Fatalf("The connection should be read again after receiving %v bytes", len(sent))
+	}
+	if report.Datapoints() != 1 {
+		t.Errorf("The partial line should not be processed before closing, got %v datapoints", report.Datapoints())
+	}
+
+	conn.Write([]byte("00000"))
+	conn.Close()
+	waitDatapoints(report, 2)
+	if report.Datapoints() != 2 {
+		t.Errorf("The partial final line should be processed on close, got %v datapoints", report.Datapoints())
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	idleTimeout := 300 * time.Millisecond
+	processor, _ := startTCPProcessor(t, idleTimeout)
+	defer processor.Close()
+
+	for name, sent := range map[string][]byte{
+		"idle":          nil,
+		"long line":     bytes.Repeat([]byte("a"), maxLineLength+10),
+		"complete line": []byte("app1.x.y 1 1500000000\n"),
+	} {
+		// the deadlines of the connection are all set after start
+		start := time.Now()
+		conn, err := net.Dial("tcp", processor.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		conn.Write(sent)
+
+		// the processor closes the connection, ending the read, once idle for a single timeout;
+		// the upper bound only catches a connection never closed, or closed after several timeouts
+		conn.SetReadDeadline(start.Add(10 * idleTimeout))
+		if _, err := ioutil.ReadAll(conn); err != nil {
+			t.Errorf("%v: the idle connection should be closed after the idle timeout: %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed < idleTimeout {
+			t.Errorf("%v: the idle connection should not be closed before %v, got %v", name, idleTimeout, elapsed)
+		}
+		conn.Close()
+	}
+}
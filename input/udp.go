@@ -0,0 +1,213 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// Backoff of the udp receive loop on read errors
+const (
+	udpMinBackoff = 10 * time.Millisecond
+	udpMaxBackoff = time.Second
+)
+
+// UDPProcessor receives graphite plaintext datapoints from UDP packets
+type UDPProcessor struct {
+	logger     *zap.Logger
+	conn       *net.UDPConn
+	packetSize int
+	queue      chan []byte
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         *sync.WaitGroup
+	stats      stats.Stats
+	overflow   uint32
+}
+
+// The UDPStatus is the state of the listener & its receive queue
+type UDPStatus struct {
+	Address       string
+	QueueLength   int
+	QueueCapacity int
+	Closed        bool
+}
+
+// CreateUDPProcessor initialize the UDPProcessor structure
+func CreateUDPProcessor(logger *zap.Logger) *UDPProcessor {
+	return &UDPProcessor{
+		logger: logger,
+	}
+}
+
+// SetupListener binds the UDP socket on the given address.
+// Packets larger than packetSize are truncated; up to queueSize packets are buffered before being dropped.
+// readBuffer is the size of the socket receive buffer, the system default if 0.
+func (processor *UDPProcessor) SetupListener(address string, packetSize int, queueSize int, readBuffer int) error {
+	if packetSize <= 0 {
+		return fmt.Errorf("invalid udp packet size: %v", packetSize)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("error resolving %v: %v", address, err)
+	}
+
+	processor.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %v: %v", address, err)
+	}
+	if readBuffer > 0 {
+		if err = processor.conn.SetReadBuffer(readBuffer); err != nil {
+			processor.conn.Close()
+			return fmt.Errorf("error setting the udp read buffer to %v: %v", readBuffer, err)
+		}
+	}
+	if err = enableOverflowCount(processor.conn); err != nil {
+		processor.logger.Warn("Drops of the udp receive buffer will not be counted", zap.Error(err))
+	}
+
+	processor.packetSize = packetSize
+	processor.queue = make(chan []byte, queueSize)
+	processor.ctx, processor.cancel = context.WithCancel(context.Background())
+	processor.wg = &sync.WaitGroup{}
+
+	return nil
+}
+
+// Run starts receiving packets & the workers processing them
+func (processor *UDPProcessor) Run(stats stats.Stats) {
+	processor.stats = stats
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		processor.wg.Add(1)
+		go func() {
+			defer processor.wg.Done()
+			for packet := range processor.queue {
+				processor.processPacket(packet)
+			}
+		}()
+	}
+
+	processor.wg.Add(1)
+	go func() {
+		defer processor.wg.Done()
+		defer close(processor.queue)
+
+		// One more byte than the packet size, to detect truncated packets.
+		buffer := make([]byte, processor.packetSize+1)
+		control := make([]byte, overflowControlSize)
+		backoff := udpMinBackoff
+		for {
+			n, controlLength, _, _, err := processor.conn.ReadMsgUDP(buffer, control)
+			if err != nil {
+				// check if context was cancelled, signaling that the listener should stop
+				if processor.ctx.Err() != nil {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && !netErr.Temporary() {
+					processor.logger.Error("Error from closed udp listener", zap.Error(err))
+					processor.cancel()
+					return
+				}
+				processor.logger.Warn("Error reading udp packet", zap.Error(err), zap.Duration("backoff", backoff))
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > udpMaxBackoff {
+					backoff = udpMaxBackoff
+				}
+				continue
+			}
+			backoff = udpMinBackoff
+
+			prometheus.IncUDPReceivedPackets()
+			if count, ok := overflowCount(control[:controlLength]); ok {
+				processor.countOverflow(count)
+			}
+			processor.enqueue(buffer[:n])
+		}
+	}()
+}
+
+// countOverflow counts the packets dropped by the socket receive buffer since the previous drops count.
+// The kernel count wraps around, as the uint32 difference.
+func (processor *UDPProcessor) countOverflow(count uint32) {
+	if dropped := count - processor.overflow; dropped > 0 {
+		prometheus.AddUDPReceiveBufferDroppedPackets(float64(dropped))
+	}
+	processor.overflow = count
+}
+
+// enqueue copies a received packet to the queue, or drops it if the queue is full.
+// Packets larger than the packet size are truncated to their last complete line.
+func (processor *UDPProcessor) enqueue(packet []byte) {
+	if len(packet) > processor.packetSize {
+		prometheus.IncUDPTruncatedPackets()
+		// The last line is incomplete.
+		end := bytes.LastIndexByte(packet[:processor.packetSize], '\n')
+		if end == -1 {
+			return
+		}
+		packet = packet[:end]
+	}
+
+	packet = append([]byte(nil), packet...)
+	select {
+	case processor.queue <- packet:
+	default:
+		prometheus.IncUDPQueueDroppedPackets()
+	}
+}
+
+// processPacket feeds every newline separated datapoint of a packet to stats.
+func (processor *UDPProcessor) processPacket(packet []byte) {
+	lines := stats.SplitLines(packet)
+	for _, line := range lines {
+		processLine(processor.logger, &processor.stats, line)
+	}
+	prometheus.ObserveUDPPacketLines(len(lines))
+}
+
+// Wait endlessly for an unrecoverable error or a INT/TERM stopping signal.
+func (processor *UDPProcessor) Wait() {
+	waitForTermination(processor.ctx, processor.logger)
+}
+
+// Close the socket & wait for queued packets to be processed before exiting.
+func (processor *UDPProcessor) Close() {
+	processor.cancel()
+	processor.conn.Close()
+	processor.wg.Wait()
+}
+
+// Status fills the UDPStatus structure
+func (processor *UDPProcessor) Status() UDPStatus {
+	return UDPStatus{
+		Address:       processor.conn.LocalAddr().String(),
+		QueueLength:   len(processor.queue),
+		QueueCapacity: cap(processor.queue),
+		Closed:        processor.ctx.Err() != nil,
+	}
+}
+
+// GetStatusHTTPHandler returns the http handler to query and retrieve the UDPStatus structure in json format
+func (processor *UDPProcessor) GetStatusHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, err := json.MarshalIndent(processor.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(content)
+	})
+}
@@ -0,0 +1,42 @@
+package input
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// overflowControlSize is the size of the control message carrying the SO_RXQ_OVFL drops count
+var overflowControlSize = syscall.CmsgSpace(4)
+
+// enableOverflowCount makes the kernel attach the number of packets dropped by the full socket receive buffer to received packets
+func enableOverflowCount(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// overflowCount returns the drops count of the socket since its creation, if attached to a received packet.
+// The kernel only attaches it once packets have been dropped.
+func overflowCount(control []byte) (uint32, bool) {
+	messages, err := syscall.ParseSocketControlMessage(control)
+	if err != nil {
+		return 0, false
+	}
+	for _, message := range messages {
+		if message.Header.Level == syscall.SOL_SOCKET && message.Header.Type == syscall.SO_RXQ_OVFL && len(message.Data) >= 4 {
+			// native endianness
+			return *(*uint32)(unsafe.Pointer(&message.Data[0])), true
+		}
+	}
+	return 0, false
+}
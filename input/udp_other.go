@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"net"
+)
+
+// overflowControlSize is 0: SO_RXQ_OVFL is linux only
+var overflowControlSize = 0
+
+// enableOverflowCount does nothing: the drops of the socket receive buffer are only counted on linux
+func enableOverflowCount(conn *net.UDPConn) error {
+	return nil
+}
+
+// overflowCount never finds any drops count
+func overflowCount(control []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,158 @@
+package input
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/stats"
+)
+
+// startUDPProcessor runs a plaintext UDPProcessor on a random local port, counting datapoints in the returned report
+func startUDPProcessor(t *testing.T, packetSize int) (*UDPProcessor, *stats.Report) {
+	processor := CreateUDPProcessor(zaptest.NewLogger(t))
+	if err := processor.SetupListener("127.0.0.1:0", packetSize, 100, 0); err != nil {
+		t.Fatalf("Failed to setup udp listener: %v", err)
+	}
+
+	report := stats.NewReport(time.Time{}, time.Time{})
+	processor.Run(testStats(report))
+	return processor, report
+}
+
+func TestUDPPackets(t *testing.T) {
+	processor, report := startUDPProcessor(t, 64)
+	defer processor.Close()
+
+	conn, err := net.Dial("udp", processor.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	receivedBefore := gatheredCounter(t, "udp_listener_received_packets_total")
+	truncatedBefore := gatheredCounter(t, "udp_listener_truncated_packets_total")
+	packetsBefore, linesBefore := gatheredHistogram(t, "udp_listener_packet_lines")
+
+	packets := []string{
+		"app1.x.y 1 1500000000\r\n\napp1.x.y 2 1500000000",
+		// 66 bytes: the third line is truncated & dropped
+		"app2.x.y 1 1500000000\napp2.x.y 2 1500000000\napp2.x.y 3 1500000000\n",
+		// truncated without any complete line: the whole packet is dropped
+		"app3.x.y.aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa 1 1500000000\n",
+	}
+	for _, packet := range packets {
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			t.Fatalf("Failed to send packet: %v", err)
+		}
+	}
+
+	waitDatapoints(report, 4)
+	for i := 0; i < 100; i++ {
+		if packets, _ := gatheredHistogram(t, "udp_listener_packet_lines"); packets-packetsBefore >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if report.Datapoints() != 4 {
+		t.Errorf("4 datapoints should be processed, got %v", report.Datapoints())
+	}
+	if received := gatheredCounter(t, "udp_listener_received_packets_total") - receivedBefore; received != 3 {
+		t.Errorf("3 packets should be received, got %v", received)
+	}
+	if truncated := gatheredCounter(t, "udp_listener_truncated_packets_total") - truncatedBefore; truncated != 2 {
+		t.Errorf("2 packets should be truncated, got %v", truncated)
+	}
+	packetsAfter, linesAfter := gatheredHistogram(t, "udp_listener_packet_lines")
+	if packetsAfter-packetsBefore != 2 || linesAfter-linesBefore != 4 {
+		t.Errorf("2 packets of 4 lines should be observed, got %v packets of %v lines", packetsAfter-packetsBefore, linesAfter-linesBefore)
+	}
+}
+
+func TestUDPQueueDrops(t *testing.T) {
+	processor := CreateUDPProcessor(zaptest.NewLogger(t))
+	processor.packetSize = 64
+	processor.queue = make(chan []byte, 2)
+
+	droppedBefore := gatheredCounter(t, "udp_listener_queue_dropped_packets_total")
+
+	packet := []byte("app1.x.y 1 1500000000\n")
+	for i := 0; i < 5; i++ {
+		processor.enqueue(packet)
+	}
+	// the queued packets must not share the receive buffer
+	packet[0] = 'b'
+
+	if dropped := gatheredCounter(t, "udp_listener_queue_dropped_packets_total") - droppedBefore; dropped != 3 {
+		t.Errorf("3 packets should be dropped, got %v", dropped)
+	}
+	if len(processor.queue) != 2 {
+		t.Errorf("2 packets should be queued, got %v", len(processor.queue))
+	}
+	if queued := string(<-processor.queue); queued != "app1.x.y 1 1500000000\n" {
+		t.Errorf("queued packet should be copied, got %q", queued)
+	}
+}
+
+func TestUDPReceiveBufferDrops(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("receive buffer drops are only counted on linux")
+	}
+	processor := CreateUDPProcessor(zaptest.NewLogger(t))
+	// the smallest receive buffer only holds a few packets
+	if err := processor.SetupListener("127.0.0.1:0", 64, 1000, 1); err != nil {
+		t.Fatalf("Failed to setup udp listener: %v", err)
+	}
+	defer processor.Close()
+
+	conn, err := net.Dial("udp", processor.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	droppedBefore := gatheredCounter(t, "udp_listener_receive_buffer_dropped_packets_total")
+	receivedBefore := gatheredCounter(t, "udp_listener_received_packets_total")
+
+	// packets are sent before reading the socket, overflowing its buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(conn, "app1.x.y %d 1500000000\n", i)
+	}
+	processor.Run(testStats(nil))
+
+	// the drops count is attached to the packets received after the drops
+	for i := 0; i < 100 && gatheredCounter(t, "udp_listener_received_packets_total")-receivedBefore < 100; i++ {
+		fmt.Fprintf(conn, "app1.x.y %d 1500000000\n", i)
+		time.Sleep(10 * time.Millisecond)
+		if gatheredCounter(t, "udp_listener_receive_buffer_dropped_packets_total") > droppedBefore {
+			break
+		}
+	}
+
+	dropped := gatheredCounter(t, "udp_listener_receive_buffer_dropped_packets_total") - droppedBefore
+	received := gatheredCounter(t, "udp_listener_received_packets_total") - receivedBefore
+	if dropped == 0 || dropped >= 100 {
+		t.Errorf("packets overflowing the receive buffer should be counted, got %v dropped & %v received", dropped, received)
+	}
+}
+
+func TestUDPCountOverflow(t *testing.T) {
+	processor := CreateUDPProcessor(zaptest.NewLogger(t))
+	droppedBefore := gatheredCounter(t, "udp_listener_receive_buffer_dropped_packets_total")
+
+	processor.countOverflow(5)
+	processor.countOverflow(5)
+	processor.overflow = math.MaxUint32 - 1
+	// the kernel count wraps around: 5 more drops
+	processor.countOverflow(3)
+
+	if dropped := gatheredCounter(t, "udp_listener_receive_buffer_dropped_packets_total") - droppedBefore; dropped != 10 {
+		t.Errorf("10 packets should be dropped, got %v", dropped)
+	}
+}
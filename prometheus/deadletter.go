@@ -0,0 +1,31 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	deadLetterMessagesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kafka",
+		Subsystem: "dead_letter",
+		Name:      "messages_total",
+		Help:      "The total number of rejected datapoints forwarded to the dead-letter topic, by reason",
+	}, []string{"reason"})
+	deadLetterErrorsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "kafka",
+		Subsystem: "dead_letter",
+		Name:      "errors_total",
+		Help:      "The total number of rejected datapoints which could not be produced to the dead-letter topic",
+	})
+)
+
+// IncDeadLetterMessages increments the number of datapoints of the given reason forwarded to the dead-letter topic
+func IncDeadLetterMessages(reason string) {
+	deadLetterMessagesCount.WithLabelValues(reason).Inc()
+}
+
+// IncDeadLetterErrors increments the number of datapoints which could not be produced to the dead-letter topic
+func IncDeadLetterErrors() {
+	deadLetterErrorsCount.Inc()
+}
@@ -68,8 +68,8 @@ func (k *KafkaConsumerMetrics) Collect(c chan<- prometheus.Metric) {
 	}
 }
 
-// NewPartitionContext prepares metrics for given partition
-func NewPartitionContext(partition int32) PartitionContext {
+// NewPartitionContext prepares metrics for given topic partition
+func NewPartitionContext(topic string, partition int32) PartitionContext {
 	// promauto automatically register metrics
 
 	messagesConsumedCounter := promauto.NewCounter(prometheus.CounterOpts{
@@ -77,7 +77,7 @@ func NewPartitionContext(partition int32) PartitionContext {
 		Subsystem:   "consumer",
 		Name:        "messages",
 		Help:        "number of message consumed",
-		ConstLabels: prometheus.Labels{"partition": fmt.Sprintf("%d", partition)},
+		ConstLabels: prometheus.Labels{"topic": topic, "partition": fmt.Sprintf("%d", partition)},
 	})
 
 	timeLagGauge := promauto.NewGauge(prometheus.GaugeOpts{
@@ -85,7 +85,7 @@ func NewPartitionContext(partition int32) PartitionContext {
 		Subsystem:   "consumer",
 		Name:        "time_lag",
 		Help:        "consumer time lag in seconds",
-		ConstLabels: prometheus.Labels{"partition": fmt.Sprintf("%d", partition)},
+		ConstLabels: prometheus.Labels{"topic": topic, "partition": fmt.Sprintf("%d", partition)},
 	})
 
 	offsetLagGauge := promauto.NewGauge(prometheus.GaugeOpts{
@@ -93,7 +93,7 @@ func NewPartitionContext(partition int32) PartitionContext {
 		Subsystem:   "consumer",
 		Name:        "offset_lag",
 		Help:        "consumer offset lag",
-		ConstLabels: prometheus.Labels{"partition": fmt.Sprintf("%d", partition)},
+		ConstLabels: prometheus.Labels{"topic": topic, "partition": fmt.Sprintf("%d", partition)},
 	})
 
 	return PartitionContext{
@@ -103,11 +103,16 @@ func NewPartitionContext(partition int32) PartitionContext {
 	}
 }
 
+// HighWaterMarker is a consumed partition, ex: a sarama.ConsumerGroupClaim or a sarama.PartitionConsumer
+type HighWaterMarker interface {
+	HighWaterMarkOffset() int64
+}
+
 // MonitorConsumerLag computes & store lag data in metrics
-func MonitorConsumerLag(context PartitionContext, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage) {
+func MonitorConsumerLag(context PartitionContext, partition HighWaterMarker, message *sarama.ConsumerMessage) {
 	if message.Offset%100 == 0 {
 		context.messagesConsumedCounter.Inc()
-		context.offsetLagGauge.Set(float64(claim.HighWaterMarkOffset() - message.Offset))
+		context.offsetLagGauge.Set(float64(partition.HighWaterMarkOffset() - message.Offset))
 		context.timeLagGauge.Set(time.Now().Sub(message.Timestamp).Seconds())
 	}
 }
@@ -1,29 +1,64 @@
 package prometheus
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"sync"
 )
 
 var (
-	metricPathCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	metricPathOpts = prometheus.CounterOpts{
 		Name: "metrics_path_total",
 		Help: "The total number of metrics paths events",
-	}, []string{"metric_path", "application", "application_type"})
-	dataPointTometricErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+	}
+	metricPathCount             *prometheus.CounterVec
+	metricPathTopicLabel        bool
+	metricPathOnce              sync.Once
+	dataPointTometricErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "metrics_error_total",
-		Help: "The total number of bad parsed metrics paths",
-	})
-	metricPathDidNotMatchAnyRulesCount = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "metric_path_did_not_match_rules_total",
-		Help: "The total number of bad parsed metrics paths",
-	})
+		Help: "The total number of datapoints which could not be parsed or classified, by reason",
+	}, []string{"reason", "application", "application_type"})
+	ruleFieldCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_rule_fields_total",
+		Help: "The total number of datapoints by value of the extra named groups of regex rules listed in their label_fields",
+	}, []string{"field", "value", "application", "application_type"})
+	metricValueQualityCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_value_quality_total",
+		Help: "The total number of datapoints with a NaN, infinite, non numeric or empty value",
+	}, []string{"quality", "application", "application_type"})
 	metricProcessedEvents = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "metrics_processed_events",
 		Help: "The total number of processed metrics",
 	})
+	messageLinesHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "metrics_message_lines",
+		Help:    "Number of datapoint lines per message",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+	timestampSkewHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metrics_timestamp_skew_seconds",
+		Help:    "Datapoint timestamps lag behind the message timestamp or the wall-clock time, negative for timestamps in the future",
+		Buckets: []float64{-3600, -600, -60, -10, 0, 10, 60, 300, 600, 1800, 3600, 21600, 86400, 604800},
+	}, []string{"reference", "application", "application_type"})
+	timestampOutOfWindowCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_timestamp_out_of_window_total",
+		Help: "The total number of datapoints with a timestamp too far in the future or in the past",
+	}, []string{"direction", "application", "application_type"})
+	metricLatenessCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_lateness_total",
+		Help: "The total number of datapoints by lateness of their timestamp relative to their arrival: live, minutes, hours or days",
+	}, []string{"bucket", "application", "application_type"})
+	backfillShareGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_backfill_share",
+		Help: "Share of datapoints at least an hour late during the last backfill window",
+	}, []string{"application", "application_type"})
+	backfillAlertGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_backfill_alert",
+		Help: "1 if the backfill share of the application crossed the backfill threshold, 0 otherwise",
+	}, []string{"application", "application_type"})
 	metricLatestTimestampGauge = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "metrics_timestamp_value",
 		Help: "Lowest and Highest Timestamp processed",
@@ -35,19 +70,64 @@ func GetPrometheusHTTPHandler() http.Handler {
 	return promhttp.Handler()
 }
 
-// IncDataPointToMetricErrorCounter increments the dataPointTometricErrorCount counter
-func IncDataPointToMetricErrorCounter() {
-	dataPointTometricErrorCount.Inc()
+// IncDataPointToMetricErrorCounter increments the dataPointTometricErrorCount counter of the given reason
+// The application & its type are the ones extracted before the error, empty if unknown.
+func IncDataPointToMetricErrorCounter(reason string, applicationName string, applicationType string) {
+	dataPointTometricErrorCount.WithLabelValues(reason, applicationName, applicationType).Inc()
+}
+
+// SetMetricPathTopicLabel registers the metrics_path_total counter with the topic label if enabled, without it otherwise.
+// The labels of a counter can not change once registered: it fails if datapoints were already counted.
+func SetMetricPathTopicLabel(enabled bool) error {
+	registered := false
+	metricPathOnce.Do(func() {
+		registerMetricPathCounter(enabled)
+		registered = true
+	})
+	if !registered && metricPathTopicLabel != enabled {
+		return fmt.Errorf("metrics_path_total is already registered with topic label %v", metricPathTopicLabel)
+	}
+	return nil
+}
+
+// registerMetricPathCounter registers the metrics_path_total counter, with the topic label if enabled
+func registerMetricPathCounter(topicLabel bool) {
+	labels := []string{"metric_path", "application", "application_type"}
+	if topicLabel {
+		labels = append(labels, "topic")
+	}
+	metricPathCount = promauto.NewCounterVec(metricPathOpts, labels)
+	metricPathTopicLabel = topicLabel
 }
 
-// IncMetricPathDidNotMatchAnyRules increments the dataPointTometricErrorCount counter
-func IncMetricPathDidNotMatchAnyRules() {
-	dataPointTometricErrorCount.Inc()
+// metricPathCounter returns the metrics_path_total counter & its label values, the topic being ignored without the topic label.
+// The counter is registered without the topic label unless set by SetMetricPathTopicLabel.
+func metricPathCounter(extractedMetric string, applicationName string, applicationType string, topic string) prometheus.Counter {
+	metricPathOnce.Do(func() { registerMetricPathCounter(false) })
+	if metricPathTopicLabel {
+		return metricPathCount.WithLabelValues(extractedMetric, applicationName, applicationType, topic)
+	}
+	return metricPathCount.WithLabelValues(extractedMetric, applicationName, applicationType)
 }
 
 // IncMetricPathCounter increments an application counter based on its extracted metric
-func IncMetricPathCounter(extractedMetric string, applicationName string, applicationType string) {
-	metricPathCount.WithLabelValues(extractedMetric, applicationName, applicationType).Inc()
+func IncMetricPathCounter(extractedMetric string, applicationName string, applicationType string, topic string) {
+	metricPathCounter(extractedMetric, applicationName, applicationType, topic).Inc()
+}
+
+// AddMetricPathCounter adds the given number of datapoints to an application counter based on its extracted metric
+func AddMetricPathCounter(count float64, extractedMetric string, applicationName string, applicationType string, topic string) {
+	metricPathCounter(extractedMetric, applicationName, applicationType, topic).Add(count)
+}
+
+// IncRuleFieldCounter increments the number of datapoints of an application with the given value of an extra regex rule field
+func IncRuleFieldCounter(field string, value string, applicationName string, applicationType string) {
+	ruleFieldCount.WithLabelValues(field, value, applicationName, applicationType).Inc()
+}
+
+// IncMetricValueQualityCounter increments the number of datapoints of an application with the given value quality issue
+func IncMetricValueQualityCounter(quality string, applicationName string, applicationType string) {
+	metricValueQualityCount.WithLabelValues(quality, applicationName, applicationType).Inc()
 }
 
 // IncMetricProcessedEvents increments number of processed metrics in total
@@ -55,6 +135,56 @@ func IncMetricProcessedEvents() {
 	metricProcessedEvents.Inc()
 }
 
+// AddMetricProcessedEvents adds the given number of processed metrics to the total
+func AddMetricProcessedEvents(count float64) {
+	metricProcessedEvents.Add(count)
+}
+
+// ObserveMessageLines records the number of datapoint lines of a message
+func ObserveMessageLines(lines int) {
+	messageLinesHistogram.Observe(float64(lines))
+}
+
+// ObserveTimestampSkew records the lag of a datapoint timestamp behind the reference time: the message timestamp or the wall-clock
+func ObserveTimestampSkew(reference string, applicationName string, applicationType string, seconds float64) {
+	timestampSkewHistogram.WithLabelValues(reference, applicationName, applicationType).Observe(seconds)
+}
+
+// TimestampSkewObserver returns the function recording the timestamp lags of an application behind the reference time,
+// for callers observing many datapoints of the same application.
+func TimestampSkewObserver(reference string, applicationName string, applicationType string) func(seconds float64) {
+	return timestampSkewHistogram.WithLabelValues(reference, applicationName, applicationType).Observe
+}
+
+// IncTimestampOutOfWindow increments the number of datapoints of an application too far in the future or in the past
+func IncTimestampOutOfWindow(direction string, applicationName string, applicationType string) {
+	timestampOutOfWindowCount.WithLabelValues(direction, applicationName, applicationType).Inc()
+}
+
+// IncMetricLatenessCounter increments the number of datapoints of an application in the given lateness bucket
+func IncMetricLatenessCounter(bucket string, applicationName string, applicationType string) {
+	metricLatenessCount.WithLabelValues(bucket, applicationName, applicationType).Inc()
+}
+
+// AddMetricLatenessCounter adds the given number of datapoints of an application in the lateness bucket
+func AddMetricLatenessCounter(count float64, bucket string, applicationName string, applicationType string) {
+	metricLatenessCount.WithLabelValues(bucket, applicationName, applicationType).Add(count)
+}
+
+// SetBackfillShare sets the share of backfilled datapoints of an application
+func SetBackfillShare(applicationName string, applicationType string, share float64) {
+	backfillShareGauge.WithLabelValues(applicationName, applicationType).Set(share)
+}
+
+// SetBackfillAlert raises or clears the backfill alert of an application
+func SetBackfillAlert(applicationName string, applicationType string, alert bool) {
+	value := 0.0
+	if alert {
+		value = 1
+	}
+	backfillAlertGauge.WithLabelValues(applicationName, applicationType).Set(value)
+}
+
 // SetMetricLatestTimestamp sets the latest processed timestamp
 func SetMetricLatestTimestamp(ts float64) {
 	metricLatestTimestampGauge.Set(ts)
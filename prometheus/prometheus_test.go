@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricPathTopicLabel(t *testing.T) {
+	if err := SetMetricPathTopicLabel(true); err != nil {
+		t.Fatalf("Failed to register the topic label: %v", err)
+	}
+	if err := SetMetricPathTopicLabel(true); err != nil {
+		t.Errorf("Setting the same topic label again should not fail: %v", err)
+	}
+	if err := SetMetricPathTopicLabel(false); err == nil {
+		t.Errorf("The topic label should not be removed once registered")
+	}
+	IncMetricPathCounter("foo.aggreg.app1", "app1", "aggreg", "metrics")
+	AddMetricPathCounter(2, "foo.aggreg.app1", "app1", "aggreg", "metrics")
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "metrics_path_total" {
+			continue
+		}
+		metric := family.GetMetric()[0]
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["topic"] != "metrics" || len(labels) != 4 || metric.GetCounter().GetValue() != 3 {
+			t.Errorf("3 datapoints should be counted with the topic label, got %v: %v", labels, metric.GetCounter().GetValue())
+		}
+		return
+	}
+	t.Errorf("metrics_path_total should be registered")
+}
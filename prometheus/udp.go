@@ -0,0 +1,65 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	udpReceivedPacketsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "udp",
+		Subsystem: "listener",
+		Name:      "received_packets_total",
+		Help:      "The total number of received udp packets",
+	})
+	udpTruncatedPacketsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "udp",
+		Subsystem: "listener",
+		Name:      "truncated_packets_total",
+		Help:      "The total number of udp packets larger than the udp packet size, truncated at reception",
+	})
+	udpQueueDroppedPacketsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "udp",
+		Subsystem: "listener",
+		Name:      "queue_dropped_packets_total",
+		Help:      "The total number of received udp packets dropped because the processing queue was full, excluding the kernel socket buffer drops",
+	})
+	udpReceiveBufferDroppedPacketsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "udp",
+		Subsystem: "listener",
+		Name:      "receive_buffer_dropped_packets_total",
+		Help:      "The total number of udp packets dropped by the kernel because the socket receive buffer was full (linux only)",
+	})
+	udpPacketLinesHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "udp",
+		Subsystem: "listener",
+		Name:      "packet_lines",
+		Help:      "Number of datapoint lines per udp packet",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+)
+
+// IncUDPReceivedPackets increments the number of received udp packets
+func IncUDPReceivedPackets() {
+	udpReceivedPacketsCount.Inc()
+}
+
+// IncUDPTruncatedPackets increments the number of truncated udp packets
+func IncUDPTruncatedPackets() {
+	udpTruncatedPacketsCount.Inc()
+}
+
+// IncUDPQueueDroppedPackets increments the number of received udp packets dropped by a full processing queue
+func IncUDPQueueDroppedPackets() {
+	udpQueueDroppedPacketsCount.Inc()
+}
+
+// AddUDPReceiveBufferDroppedPackets adds to the number of udp packets dropped by a full socket receive buffer
+func AddUDPReceiveBufferDroppedPackets(dropped float64) {
+	udpReceiveBufferDroppedPacketsCount.Add(dropped)
+}
+
+// ObserveUDPPacketLines records the number of lines of an udp packet
+func ObserveUDPPacketLines(lines int) {
+	udpPacketLinesHistogram.Observe(float64(lines))
+}
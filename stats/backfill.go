@@ -0,0 +1,187 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+)
+
+// Lateness buckets of datapoints, by their timestamp relative to their arrival time
+const (
+	latenessLive    = "live"
+	latenessMinutes = "minutes"
+	latenessHours   = "hours"
+	latenessDays    = "days"
+)
+
+// latenessBucket returns the bucket of a datapoint arrived lateness after its timestamp.
+// Datapoints less than 2 minutes late, or in the future, are live; datapoints at least an hour late are backfilled.
+func latenessBucket(lateness time.Duration) string {
+	switch {
+	case lateness < 2*time.Minute:
+		return latenessLive
+	case lateness < time.Hour:
+		return latenessMinutes
+	case lateness < 24*time.Hour:
+		return latenessHours
+	}
+	return latenessDays
+}
+
+// BackfillTracker computes the share of backfilled datapoints per application over a time window,
+// and raises an alert for applications whose share reaches the threshold, with at least minDatapoints datapoints in the window.
+// It is safe for concurrent use.
+type BackfillTracker struct {
+	threshold     float64
+	window        time.Duration
+	minDatapoints uint64
+	mutex         sync.Mutex
+	windowStart   time.Time
+	counts        map[backfillApplication]*backfillCount
+	alerting      map[backfillApplication]bool
+}
+
+// backfillExpireInterval is the largest interval between the end of a window & its evaluation without new datapoints
+const backfillExpireInterval = time.Second
+
+// backfillApplication identifies an application tracked by the BackfillTracker
+type backfillApplication struct {
+	name            string
+	applicationType string
+}
+
+// backfillCount is the number of datapoints & backfilled datapoints of an application in the current window
+type backfillCount struct {
+	total    uint64
+	backfill uint64
+}
+
+// NewBackfillTracker initializes a BackfillTracker; threshold is a share between 0 excluded & 1.
+func NewBackfillTracker(threshold float64, window time.Duration, minDatapoints uint64) (*BackfillTracker, error) {
+	if threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("backfill threshold %v is not a share between 0 excluded and 1", threshold)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid backfill window: %v", window)
+	}
+
+	return &BackfillTracker{
+		threshold:     threshold,
+		window:        window,
+		minDatapoints: minDatapoints,
+		counts:        make(map[backfillApplication]*backfillCount),
+		alerting:      make(map[backfillApplication]bool),
+	}, nil
+}
+
+// add counts a datapoint of the application, evaluating the backfill shares of the previous window once it is over
+func (tracker *BackfillTracker) add(logger *zap.Logger, application backfillApplication, backfill bool, now time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.windowStart.IsZero() {
+		tracker.windowStart = now
+	} else if now.Sub(tracker.windowStart) >= tracker.window {
+		tracker.evaluate(logger)
+		tracker.windowStart = now
+	}
+
+	count, ok := tracker.counts[application]
+	if !ok {
+		count = &backfillCount{}
+		tracker.counts[application] = count
+	}
+	count.total++
+	if backfill {
+		count.backfill++
+	}
+}
+
+// Expire evaluates the backfill shares of the current window once it is over, even if no datapoint arrived since,
+// so that the shares & alerts of applications which stopped sending are cleared.
+func (tracker *BackfillTracker) Expire(logger *zap.Logger, now time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if !tracker.windowStart.IsZero() && now.Sub(tracker.windowStart) >= tracker.window {
+		tracker.evaluate(logger)
+		tracker.windowStart = now
+	}
+}
+
+// Run expires the windows until the context is cancelled, to be started in a goroutine.
+func (tracker *BackfillTracker) Run(ctx context.Context, logger *zap.Logger) {
+	interval := backfillExpireInterval
+	if tracker.window < interval {
+		interval = tracker.window
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tracker.Expire(logger, now)
+		}
+	}
+}
+
+// evaluate sets the backfill share of every application of the window, raises or clears their alerts, and starts a new window.
+// Applications without datapoints in the window have their share & alert cleared.
+func (tracker *BackfillTracker) evaluate(logger *zap.Logger) {
+	for application, alerting := range tracker.alerting {
+		if _, ok := tracker.counts[application]; ok {
+			continue
+		}
+		prometheus.SetBackfillShare(application.name, application.applicationType, 0)
+		if alerting {
+			prometheus.SetBackfillAlert(application.name, application.applicationType, false)
+			logger.Info("Application stopped backfilling", zap.String("application", application.name), zap.String("applicationType", application.applicationType))
+		}
+		delete(tracker.alerting, application)
+	}
+
+	for application, count := range tracker.counts {
+		share := float64(count.backfill) / float64(count.total)
+		prometheus.SetBackfillShare(application.name, application.applicationType, share)
+
+		alert := count.total >= tracker.minDatapoints && share >= tracker.threshold
+		if alert != tracker.alerting[application] {
+			prometheus.SetBackfillAlert(application.name, application.applicationType, alert)
+			if alert {
+				logger.Warn("Application started backfilling", zap.String("application", application.name), zap.String("applicationType", application.applicationType),
+					zap.Float64("share", share), zap.Uint64("datapoints", count.total))
+			} else {
+				logger.Info("Application stopped backfilling", zap.String("application", application.name), zap.String("applicationType", application.applicationType),
+					zap.Float64("share", share), zap.Uint64("datapoints", count.total))
+			}
+		}
+		tracker.alerting[application] = alert
+	}
+
+	tracker.counts = make(map[backfillApplication]*backfillCount)
+}
+
+// observeLateness counts the metric in its lateness bucket, relative to the datapoint arrival time (ex: kafka message timestamp),
+// or the wall-clock time if unknown.
+func (stats *Stats) observeLateness(logger *zap.Logger, metric Metric, datapoint Datapoint, extractedMetric ExtractedMetric, now time.Time) {
+	arrival := datapoint.Timestamp
+	if arrival.IsZero() {
+		arrival = now
+	}
+
+	bucket := latenessBucket(arrival.Sub(time.Unix(int64(metric.Timestamp), 0)))
+	stats.incLateness(bucket, extractedMetric)
+
+	if stats.Backfill != nil {
+		application := backfillApplication{extractedMetric.ApplicationName, extractedMetric.ApplicationType}
+		stats.Backfill.add(logger, application, bucket == latenessHours || bucket == latenessDays, now)
+	}
+}
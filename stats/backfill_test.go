@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLatenessBucket(t *testing.T) {
+	buckets := map[time.Duration]string{
+		-time.Hour:          latenessLive,
+		30 * time.Second:    latenessLive,
+		5 * time.Minute:     latenessMinutes,
+		3 * time.Hour:       latenessHours,
+		24 * time.Hour:      latenessDays,
+		30 * 24 * time.Hour: latenessDays,
+	}
+	for lateness, expected := range buckets {
+		if bucket := latenessBucket(lateness); bucket != expected {
+			t.Errorf("Invalid bucket of lateness %v: exp. %v got %v", lateness, expected, bucket)
+		}
+	}
+}
+
+func TestNewBackfillTracker(t *testing.T) {
+	for _, threshold := range []float64{0, -0.5, 1.5} {
+		if _, err := NewBackfillTracker(threshold, time.Minute, 10); err == nil {
+			t.Errorf("Creating a backfill tracker with threshold %v should fail", threshold)
+		}
+	}
+	if _, err := NewBackfillTracker(0.5, 0, 10); err == nil {
+		t.Errorf("Creating a backfill tracker without window should fail")
+	}
+}
+
+func TestBackfillTracker(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	tracker, err := NewBackfillTracker(0.5, time.Minute, 4)
+	if err != nil {
+		t.Fatalf("Failed to create backfill tracker: %v", err)
+	}
+	stats := Stats{Backfill: tracker}
+	now := time.Unix(1500000000, 0)
+	backfiller := ExtractedMetric{ApplicationName: "backfiller", ApplicationType: "backfill-test"}
+	small := ExtractedMetric{ApplicationName: "small", ApplicationType: "backfill-test"}
+	labels := func(application string) map[string]string {
+		return map[string]string{"application": application, "application_type": "backfill-test"}
+	}
+
+	// first window: backfiller sends 3 datapoints days late out of 4, small sends its only datapoint hours late
+	for _, lateness := range []time.Duration{0, 48 * time.Hour, 48 * time.Hour, 48 * time.Hour} {
+		stats.observeLateness(logger, Metric{Timestamp: uint32(now.Add(-lateness).Unix())}, Datapoint{}, backfiller, now)
+	}
+	stats.observeLateness(logger, Metric{Timestamp: uint32(now.Add(-2 * time.Hour).Unix())}, Datapoint{Timestamp: now}, small, now)
+
+	// the next datapoint closes the first window
+	now = now.Add(time.Minute)
+	stats.observeLateness(logger, Metric{Timestamp: uint32(now.Unix())}, Datapoint{}, backfiller, now)
+
+	if count := gatheredValue(t, "metrics_lateness_total", map[string]string{"bucket": "days", "application": "backfiller", "application_type": "backfill-test"}); count != 3 {
+		t.Errorf("3 datapoints should be days late, got %v", count)
+	}
+	if share := gatheredValue(t, "metrics_backfill_share", labels("backfiller")); share != 0.75 {
+		t.Errorf("The backfill share should be 0.75, got %v", share)
+	}
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels("backfiller")); alert != 1 {
+		t.Errorf("The backfill alert should be raised, got %v", alert)
+	}
+	if share := gatheredValue(t, "metrics_backfill_share", labels("small")); share != 1 {
+		t.Errorf("The backfill share of small should be 1, got %v", share)
+	}
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels("small")); alert != 0 {
+		t.Errorf("The backfill alert should not be raised below the minimum number of datapoints, got %v", alert)
+	}
+
+	// second window: backfiller is live, small stopped sending
+	now = now.Add(time.Minute)
+	stats.observeLateness(logger, Metric{Timestamp: uint32(now.Unix())}, Datapoint{}, backfiller, now)
+
+	if share := gatheredValue(t, "metrics_backfill_share", labels("backfiller")); share != 0 {
+		t.Errorf("The backfill share should be cleared, got %v", share)
+	}
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels("backfiller")); alert != 0 {
+		t.Errorf("The backfill alert should be cleared, got %v", alert)
+	}
+	if share := gatheredValue(t, "metrics_backfill_share", labels("small")); share != 0 {
+		t.Errorf("The backfill share of an application without datapoints should be cleared, got %v", share)
+	}
+}
+
+func TestBackfillTrackerExpire(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	tracker, err := NewBackfillTracker(0.5, time.Minute, 2)
+	if err != nil {
+		t.Fatalf("Failed to create backfill tracker: %v", err)
+	}
+	stats := Stats{Backfill: tracker}
+	now := time.Unix(1500000000, 0)
+	stopped := ExtractedMetric{ApplicationName: "stopped", ApplicationType: "backfill-test"}
+	labels := map[string]string{"application": "stopped", "application_type": "backfill-test"}
+
+	// the application only sends backfilled datapoints, then stops sending
+	for i := 0; i < 2; i++ {
+		stats.observeLateness(logger, Metric{Timestamp: uint32(now.Add(-48 * time.Hour).Unix())}, Datapoint{}, stopped, now)
+	}
+
+	tracker.Expire(logger, now.Add(30*time.Second))
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels); alert != 0 {
+		t.Errorf("The window should not be evaluated before its end, got alert %v", alert)
+	}
+
+	// the first window is evaluated at its end without new datapoints
+	now = now.Add(time.Minute)
+	tracker.Expire(logger, now)
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels); alert != 1 {
+		t.Errorf("The backfill alert should be raised at the end of the window, got %v", alert)
+	}
+
+	// the alert clears once a window without datapoints is over
+	now = now.Add(time.Minute)
+	tracker.Expire(logger, now)
+	if share := gatheredValue(t, "metrics_backfill_share", labels); share != 0 {
+		t.Errorf("The backfill share should be cleared without new datapoints, got %v", share)
+	}
+	if alert := gatheredValue(t, "metrics_backfill_alert", labels); alert != 0 {
+		t.Errorf("The backfill alert should be cleared without new datapoints, got %v", alert)
+	}
+}
+
+func TestBackfillTrackerRun(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	tracker, err := NewBackfillTracker(0.5, 50*time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("Failed to create backfill tracker: %v", err)
+	}
+	stats := Stats{Backfill: tracker}
+	running := ExtractedMetric{ApplicationName: "running", ApplicationType: "backfill-test"}
+	labels := map[string]string{"application": "running", "application_type": "backfill-test"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tracker.Run(ctx, logger)
+	now := time.Now()
+	stats.observeLateness(logger, Metric{Timestamp: uint32(now.Add(-48 * time.Hour).Unix())}, Datapoint{}, running, now)
+
+	raised := false
+	for i := 0; i < 100; i++ {
+		alert := gatheredValue(t, "metrics_backfill_alert", labels)
+		if alert == 1 {
+			raised = true
+		} else if raised {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("The backfill alert should be raised, then cleared without new datapoints: raised %v", raised)
+}
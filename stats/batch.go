@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"github.com/criteo/graphite-writer-stats/prometheus"
+)
+
+// Batch accumulates the counter increments made for every processed datapoint, to update the shared prometheus counters
+// once per flush instead of once per datapoint. Timestamp skews are observed immediately, with observers cached until the flush,
+// so that the cache does not grow with every application ever seen.
+// A Batch must not be used concurrently.
+type Batch struct {
+	processed uint64
+	paths     map[pathLabels]uint64
+	lateness  map[latenessLabels]uint64
+	skews     map[skewLabels]func(float64)
+}
+
+// pathLabels are the labels of metrics_path_total
+type pathLabels struct {
+	metricPath      string
+	application     string
+	applicationType string
+	topic           string
+}
+
+// latenessLabels are the labels of metrics_lateness_total
+type latenessLabels struct {
+	bucket          string
+	application     string
+	applicationType string
+}
+
+// skewLabels are the labels of metrics_timestamp_skew_seconds
+type skewLabels struct {
+	reference       string
+	application     string
+	applicationType string
+}
+
+// NewBatch initializes an empty Batch
+func NewBatch() *Batch {
+	return &Batch{
+		paths:    make(map[pathLabels]uint64),
+		lateness: make(map[latenessLabels]uint64),
+		skews:    make(map[skewLabels]func(float64)),
+	}
+}
+
+// Batched returns a copy of the stats counting processed datapoints in the batch, until it is flushed.
+func (stats Stats) Batched(batch *Batch) Stats {
+	stats.batch = batch
+	return stats
+}
+
+// Flush adds the accumulated increments to the prometheus counters, and empties the batch & its observers cache
+func (batch *Batch) Flush() {
+	if batch.processed > 0 {
+		prometheus.AddMetricProcessedEvents(float64(batch.processed))
+		batch.processed = 0
+	}
+	for labels, count := range batch.paths {
+		prometheus.AddMetricPathCounter(float64(count), labels.metricPath, labels.application, labels.applicationType, labels.topic)
+		delete(batch.paths, labels)
+	}
+	for labels, count := range batch.lateness {
+		prometheus.AddMetricLatenessCounter(float64(count), labels.bucket, labels.application, labels.applicationType)
+		delete(batch.lateness, labels)
+	}
+	for labels := range batch.skews {
+		delete(batch.skews, labels)
+	}
+}
+
+// incProcessed increments the number of processed datapoints
+func (stats *Stats) incProcessed() {
+	if stats.batch != nil {
+		stats.batch.processed++
+		return
+	}
+	prometheus.IncMetricProcessedEvents()
+}
+
+// incPath increments the number of datapoints of an extracted metric
+func (stats *Stats) incPath(extractedMetric ExtractedMetric, topic string) {
+	if stats.batch != nil {
+		stats.batch.paths[pathLabels{extractedMetric.ExtractedMetric, extractedMetric.ApplicationName, extractedMetric.ApplicationType, topic}]++
+		return
+	}
+	prometheus.IncMetricPathCounter(extractedMetric.ExtractedMetric, extractedMetric.ApplicationName, extractedMetric.ApplicationType, topic)
+}
+
+// incLateness increments the number of datapoints of an application in the lateness bucket
+func (stats *Stats) incLateness(bucket string, extractedMetric ExtractedMetric) {
+	if stats.batch != nil {
+		stats.batch.lateness[latenessLabels{bucket, extractedMetric.ApplicationName, extractedMetric.ApplicationType}]++
+		return
+	}
+	prometheus.IncMetricLatenessCounter(bucket, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+}
+
+// observeSkewSeconds records the lag of a datapoint timestamp of an application behind the reference time
+func (stats *Stats) observeSkewSeconds(reference string, extractedMetric ExtractedMetric, seconds float64) {
+	if stats.batch == nil {
+		prometheus.ObserveTimestampSkew(reference, extractedMetric.ApplicationName, extractedMetric.ApplicationType, seconds)
+		return
+	}
+
+	labels := skewLabels{reference, extractedMetric.ApplicationName, extractedMetric.ApplicationType}
+	observe, ok := stats.batch.skews[labels]
+	if !ok {
+		observe = prometheus.TimestampSkewObserver(reference, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+		stats.batch.skews[labels] = observe
+	}
+	observe(seconds)
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+)
+
+func TestBatch(t *testing.T) {
+	batch := NewBatch()
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "batch", Pattern: []string{"batch"}, ApplicationNamePosition: 1}}},
+			ComponentsNb: 3,
+		},
+	}.Batched(batch)
+	labels := map[string]string{"metric_path": "batch.app1.x", "application": "app1", "application_type": "batch"}
+
+	if err := stats.ProcessMessage(zaptest.NewLogger(t), Datapoint{Value: []byte("batch.app1.x.y 1 1500000000\nbatch.app1.x.z 1 1500000000")}); err != nil {
+		t.Fatalf("Failed to process message: %v", err)
+	}
+	if count := gatheredValue(t, "metrics_path_total", labels); count != 0 {
+		t.Errorf("Batched datapoints should not be counted before flushing, got %v", count)
+	}
+
+	if len(batch.skews) == 0 {
+		t.Errorf("Skew observers should be cached until flushing")
+	}
+	batch.Flush()
+	if count := gatheredValue(t, "metrics_path_total", labels); count != 2 {
+		t.Errorf("2 datapoints should be counted once flushed, got %v", count)
+	}
+	if len(batch.skews) != 0 {
+		t.Errorf("Skew observers should not be cached after flushing, got %v", len(batch.skews))
+	}
+	if count := gatheredValue(t, "metrics_lateness_total", map[string]string{"bucket": "days", "application": "app1", "application_type": "batch"}); count != 2 {
+		t.Errorf("2 datapoints should be days late once flushed, got %v", count)
+	}
+
+	batch.Flush()
+	if count := gatheredValue(t, "metrics_path_total", labels); count != 2 {
+		t.Errorf("Flushing an empty batch should not count datapoints, got %v", count)
+	}
+}
+
+func TestTopicLabel(t *testing.T) {
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "topic", Pattern: []string{"topic"}, ApplicationNamePosition: 1}}},
+			ComponentsNb: 3,
+		},
+		TopicLabel: true,
+	}
+	labels := map[string]string{"metric_path": "topic.app1.x", "application": "app1", "application_type": "topic"}
+
+	// the counter is registered without the topic label by default
+	if err := stats.Process(zaptest.NewLogger(t), Datapoint{Value: []byte("topic.app1.x.y 1 1500000000"), Source: "metrics"}); err != nil {
+		t.Fatalf("Failed to process datapoint: %v", err)
+	}
+	if count := gatheredValue(t, "metrics_path_total", labels); count != 1 {
+		t.Errorf("1 datapoint should be counted without topic label, got %v", count)
+	}
+	labels["topic"] = "metrics"
+	if count := gatheredValue(t, "metrics_path_total", labels); count != 0 {
+		t.Errorf("The topic label should not be registered by default, got %v", count)
+	}
+	if err := prometheus.SetMetricPathTopicLabel(true); err == nil {
+		t.Errorf("The topic label should not be enabled once datapoints are counted")
+	}
+}
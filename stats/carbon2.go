@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BuildMetricFromCarbon2 is retrieving a Metric from a received datapoint in the carbon 2.0 format
+// "intrinsic_tags  meta_tags value timestamp", intrinsic & meta tags being separated by two spaces.
+// Intrinsic tags are used as the metric tags, and as its path once sorted & joined with dots (ex: "host=foo.unit=B");
+// meta tags are ignored.
+func BuildMetricFromCarbon2(datapoint Datapoint) (Metric, error) {
+	metric := Metric{}
+	metric.Tags = make(map[string]string, 0)
+
+	indexSeparator := bytes.Index(datapoint.Value, []byte("  "))
+	if indexSeparator <= 0 {
+		return metric, newParseError(reasonMissingSpace, "Missing double space after intrinsic tags")
+	}
+
+	for k, v := range datapoint.Tags {
+		metric.Tags[k] = v
+	}
+
+	intrinsicTags := strings.Split(string(datapoint.Value[:indexSeparator]), " ")
+	for _, tag := range intrinsicTags {
+		indexEqual := strings.IndexByte(tag, '=')
+		if indexEqual <= 0 || indexEqual == len(tag)-1 {
+			return metric, &ParseError{Reason: reasonInvalidTag, Err: fmt.Errorf("Invalid intrinsic tag `%v`", tag)}
+		}
+		metric.Tags[tag[:indexEqual]] = tag[indexEqual+1:]
+	}
+	sort.Strings(intrinsicTags)
+	metric.Path = strings.Join(intrinsicTags, ".")
+
+	// meta tags, value & timestamp
+	fields := bytes.Fields(datapoint.Value[indexSeparator:])
+	if len(fields) < 2 {
+		return metric, newPathParseError(reasonMissingTimestamp, metric.Path, metric.Tags, "Missing value or timestamp after tags")
+	}
+
+	var err error
+	metric.Value = string(fields[len(fields)-2])
+	metric.Timestamp, err = parseTimestamp(metric, string(fields[len(fields)-1]))
+
+	return metric, err
+}
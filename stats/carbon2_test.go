@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBuildMetricFromCarbon2(t *testing.T) {
+	datapoint := Datapoint{Value: []byte("unit=B mtype=gauge what=disk_used host=web01  agent=diamond 42 1498887"), Tags: map[string]string{"host": "header", "dc": "dc1"}}
+	metric, err := BuildMetricFromCarbon2(datapoint)
+	if err != nil {
+		t.Errorf("failed to build metric from '%v': %v", string(datapoint.Value), err)
+	}
+	expected := Metric{
+		Path:      "host=web01.mtype=gauge.unit=B.what=disk_used",
+		Tags:      map[string]string{"unit": "B", "mtype": "gauge", "what": "disk_used", "host": "web01", "dc": "dc1"},
+		Timestamp: 1498887,
+		Value:     "42",
+	}
+	if !reflect.DeepEqual(metric, expected) {
+		t.Errorf("invalid metric built:\nExp. %v\nGot: %v", expected, metric)
+	}
+
+	datapoint = Datapoint{Value: []byte("unit=B what=disk_used  42 1498887")}
+	metric, err = BuildMetricFromCarbon2(datapoint)
+	if err != nil || metric.Path != "unit=B.what=disk_used" || metric.Timestamp != 1498887 {
+		t.Errorf("failed to build metric without meta tags from '%v': %v, %v", string(datapoint.Value), metric, err)
+	}
+
+	reasons := map[string]string{
+		"unit=B what=disk_used 42 1498887":       "missing_space",
+		"  42 1498887":                           "missing_space",
+		"unit=B what  42 1498887":                "invalid_tag",
+		"unit=B what=disk_used  1498887":         "missing_timestamp",
+		"unit=B what=disk_used  42 abc":          "invalid_timestamp",
+		"unit=B what=disk_used  42 -1":           "timestamp_out_of_range",
+		"unit=B what=disk_used  42 100000000000": "timestamp_out_of_range",
+	}
+	for value, reason := range reasons {
+		if _, err := BuildMetricFromCarbon2(Datapoint{Value: []byte(value)}); err == nil || ErrorReason(err) != reason {
+			t.Errorf("building metric from an invalid carbon 2.0 datapoint '%v' should fail with reason %v: %v", value, reason, err)
+		}
+	}
+
+	var parseError *ParseError
+	_, err = BuildMetricFromCarbon2(Datapoint{Value: []byte("unit=B what=disk_used  42 abc")})
+	if !errors.As(err, &parseError) || parseError.Path != "unit=B.what=disk_used" || parseError.Tags["what"] != "disk_used" {
+		t.Errorf("the error should contain the path & tags of the datapoint: %#v", err)
+	}
+}
+
+func TestProcessCarbon2(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "by-tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+			ComponentsNb: 3,
+		},
+		Format: FormatCarbon2,
+	}
+
+	metrics, err := stats.BuildMetrics(Datapoint{Value: []byte("appname=testaroo what=requests  42 1498887")})
+	if err != nil || len(metrics) != 1 {
+		t.Fatalf("failed to build carbon 2.0 metric: %v", err)
+	}
+	extractedMetric := stats.getMetric(logger, metrics[0].Path, metrics[0].Tags)
+	if extractedMetric.ApplicationName != "testaroo" || extractedMetric.ApplicationType != "by-tag" {
+		t.Errorf("tag rule should match carbon 2.0 intrinsic tags: %v", extractedMetric)
+	}
+}
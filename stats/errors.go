@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons of the errors building or classifying a plaintext, carbon 2.0, OpenTSDB or influx metric
+const (
+	reasonMissingSpace        = "missing_space"
+	reasonEmptyPath           = "empty_path"
+	reasonInvalidTag          = "invalid_tag"
+	reasonNonNumericValue     = "non_numeric_value"
+	reasonEmptyValue          = "empty_value"
+	reasonMissingTimestamp    = "missing_timestamp"
+	reasonInvalidTimestamp    = "invalid_timestamp"
+	reasonTimestampOutOfRange = "timestamp_out_of_range"
+	reasonNoMatchingRule      = "no_matching_rule"
+	reasonApplicationPosition = "application_position_out_of_range"
+	reasonEmptyApplication    = "empty_application"
+	reasonEmptyMessage        = "empty_message"
+	reasonMissingCommand      = "missing_command"
+	reasonInvalidField        = "invalid_field"
+	reasonNoNumericField      = "no_numeric_field"
+)
+
+// Reasons of the errors building a json metric
+const (
+	reasonJSONSyntax           = "json_syntax"
+	reasonJSONInvalidTags      = "json_invalid_tags"
+	reasonJSONMissingPath      = "json_missing_path"
+	reasonJSONInvalidPath      = "json_invalid_path"
+	reasonJSONMissingValue     = "json_missing_value"
+	reasonJSONInvalidValue     = "json_invalid_value"
+	reasonJSONMissingTimestamp = "json_missing_timestamp"
+	reasonJSONInvalidTimestamp = "json_invalid_timestamp"
+)
+
+// Reasons of the errors decoding datapoints in inputs, before building their Metric
+const (
+	ReasonPickleFrame     = "pickle_frame"
+	ReasonPickleDatapoint = "pickle_datapoint"
+)
+
+// ParseError is an error building or classifying a Metric, with the reason used to label metrics_error_total
+// Path & Tags are set once the metric path is parsed, to find out the application of the invalid datapoint.
+// Application & ApplicationType are set if the application is known, ex: when its position is beyond the path depth.
+type ParseError struct {
+	Reason          string
+	Err             error
+	Path            string
+	Tags            map[string]string
+	Application     string
+	ApplicationType string
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError builds a ParseError of the given reason
+func newParseError(reason string, message string) *ParseError {
+	return &ParseError{Reason: reason, Err: errors.New(message)}
+}
+
+// newPathParseError builds a ParseError of the given reason, for a datapoint of the given path & tags
+func newPathParseError(reason string, path string, tags map[string]string, format string, args ...interface{}) *ParseError {
+	return &ParseError{Reason: reason, Err: fmt.Errorf(format, args...), Path: path, Tags: tags}
+}
+
+// ErrorReason returns the reason of a ParseError, or "parse" for any other error
+func ErrorReason(err error) string {
+	var parseError *ParseError
+	if errors.As(err, &parseError) {
+		return parseError.Reason
+	}
+	return "parse"
+}
@@ -0,0 +1,130 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Format is the format of received datapoints
+type Format string
+
+const (
+	// FormatAuto detects the format of each datapoint
+	FormatAuto Format = "auto"
+	// FormatPlain is the graphite plaintext format: "path value timestamp"
+	FormatPlain Format = "plain"
+	// FormatCarbon2 is the carbon 2.0 (metrics2.0) format: "intrinsic_tags  meta_tags value timestamp"
+	FormatCarbon2 Format = "carbon2"
+	// FormatInflux is the influx line protocol: "measurement,tag=value field=value timestamp"
+	FormatInflux Format = "influx"
+	// FormatOpenTSDB is the OpenTSDB telnet format: "put metric timestamp value tag=value"
+	FormatOpenTSDB Format = "opentsdb"
+	// FormatJSON is a json object: {"path": "foo.bar", "value": 42, "timestamp": 1498887, "tags": {"tag": "value"}}
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the Format of the given name
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatAuto, FormatPlain, FormatCarbon2, FormatInflux, FormatOpenTSDB, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format `%v`", name)
+}
+
+// DetectFormat guesses the format of a datapoint line.
+func DetectFormat(line []byte) Format {
+	if bytes.HasPrefix(line, []byte("put ")) {
+		return FormatOpenTSDB
+	}
+	if isJSONMessage(line) {
+		return FormatJSON
+	}
+
+	indexSpace := bytes.IndexByte(line, ' ')
+	if indexSpace == -1 {
+		return FormatPlain
+	}
+	if bytes.IndexByte(line[:indexSpace], '=') != -1 && bytes.Contains(line, []byte("  ")) {
+		return FormatCarbon2
+	}
+
+	// the second field of the influx line protocol is made of key=value fields, instead of a plain value
+	second := line[indexSpace+1:]
+	if indexEnd := bytes.IndexByte(second, ' '); indexEnd != -1 {
+		second = second[:indexEnd]
+	}
+	if bytes.IndexByte(second, '=') != -1 {
+		return FormatInflux
+	}
+	return FormatPlain
+}
+
+// ParseTopicFormats parses a comma separated list of topic=format, ex: "metrics-json=json,metrics=plain"
+func ParseTopicFormats(topicFormats string) (map[string]Format, error) {
+	formats := make(map[string]Format)
+	if len(topicFormats) == 0 {
+		return formats, nil
+	}
+
+	for _, topicFormat := range strings.Split(topicFormats, ",") {
+		indexEqual := strings.IndexByte(topicFormat, '=')
+		if indexEqual <= 0 {
+			return nil, fmt.Errorf("invalid topic format `%v`, expected topic=format", topicFormat)
+		}
+		format, err := ParseFormat(topicFormat[indexEqual+1:])
+		if err != nil {
+			return nil, err
+		}
+		formats[topicFormat[:indexEqual]] = format
+	}
+	return formats, nil
+}
+
+// formatOf returns the format of a received datapoint: the one of its source if configured, the default one otherwise.
+func (stats *Stats) formatOf(datapoint Datapoint) Format {
+	if format, ok := stats.TopicFormats[datapoint.Source]; ok {
+		return format
+	}
+	return stats.Format
+}
+
+// BuildMetrics is retrieving the Metrics of a received datapoint in the configured format.
+// The plaintext format is used when no format is configured. Metrics of empty or non numeric values are rejected.
+func (stats *Stats) BuildMetrics(datapoint Datapoint) ([]Metric, error) {
+	format := stats.formatOf(datapoint)
+	if format == FormatAuto {
+		format = DetectFormat(datapoint.Value)
+	}
+
+	var metrics []Metric
+	var metric Metric
+	var err error
+	switch format {
+	case FormatInflux:
+		metrics, err = BuildMetricsFromInflux(datapoint, stats.InfluxTemplate)
+	case FormatCarbon2:
+		metric, err = BuildMetricFromCarbon2(datapoint)
+	case FormatOpenTSDB:
+		metric, err = BuildMetricFromOpenTSDB(datapoint)
+	case FormatJSON:
+		metric, err = BuildMetricFromJSON(datapoint)
+	default:
+		metric, err = BuildMetricFromDatapoint(datapoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if metrics == nil {
+		metrics = []Metric{metric}
+	}
+
+	// Empty & non numeric values are rejected whatever the format
+	for _, metric := range metrics {
+		if err := checkValue(metric); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"auto", "plain", "carbon2", "influx", "opentsdb", "json"} {
+		if format, err := ParseFormat(name); err != nil || string(format) != name {
+			t.Errorf("failed to parse format `%v`: %v", name, err)
+		}
+	}
+	if _, err := ParseFormat("unknown"); err == nil {
+		t.Error("parsing an unknown format should fail")
+	}
+}
+
+func TestParseTopicFormats(t *testing.T) {
+	formats, err := ParseTopicFormats("metrics-json=json,metrics=plain")
+	expected := map[string]Format{"metrics-json": FormatJSON, "metrics": FormatPlain}
+	if err != nil || !reflect.DeepEqual(formats, expected) {
+		t.Errorf("failed to parse topic formats: %v, %v", formats, err)
+	}
+	if formats, err := ParseTopicFormats(""); err != nil || len(formats) != 0 {
+		t.Errorf("failed to parse empty topic formats: %v, %v", formats, err)
+	}
+	for _, invalid := range []string{"metrics", "=json", "metrics=unknown"} {
+		if _, err := ParseTopicFormats(invalid); err == nil {
+			t.Errorf("parsing invalid topic formats should fail: `%v`", invalid)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	lines := map[string]Format{
+		"foo.bar 42 1498887":                        FormatPlain,
+		"foo.bar;appname=testaroo 42 1498887":       FormatPlain,
+		"foo.bar  42 1498887":                       FormatPlain,
+		"unit=B what=disk_used  42 1498887":         FormatCarbon2,
+		"unit=B what=disk_used  agent=x 42 1498887": FormatCarbon2,
+		"cpu,host=web01 usage_idle=42 1498887":      FormatInflux,
+		"cpu value=42":                              FormatInflux,
+		"put sys.cpu.user 1498887 42 host=web01":    FormatOpenTSDB,
+		`{"path": "foo.bar", "value": 42}`:          FormatJSON,
+	}
+	for line, expected := range lines {
+		if format := DetectFormat([]byte(line)); format != expected {
+			t.Errorf("invalid format detected for `%v`: %v instead of %v", line, format, expected)
+		}
+	}
+}
+
+func TestBuildMetricsAuto(t *testing.T) {
+	stats := Stats{Format: FormatAuto}
+	lines := map[string]string{
+		"foo.bar 42 1498887":                                     "foo.bar",
+		"unit=B what=disk_used  42 1498887":                      "unit=B.what=disk_used",
+		"cpu,host=web01 usage_idle=42 1498887000000":             "cpu.usage_idle",
+		"put sys.cpu.user 1498887 42 host=web01":                 "sys.cpu.user",
+		`{"path": "foo.bar", "value": 42, "timestamp": 1498887}`: "foo.bar",
+	}
+	for line, path := range lines {
+		metrics, err := stats.BuildMetrics(Datapoint{Value: []byte(line)})
+		if err != nil || len(metrics) != 1 || metrics[0].Path != path {
+			t.Errorf("failed to build metric from `%v`: %v, %v", line, metrics, err)
+		}
+	}
+}
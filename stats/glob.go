@@ -0,0 +1,152 @@
+package stats
+
+import (
+	"strings"
+)
+
+// globCharacters are the characters of a rule pattern component making it a glob rather than a literal
+const globCharacters = "*?[{"
+
+// matchPattern reports whether the first components of a metric path match every component of the rule pattern
+func matchPattern(pattern []string, components []string) bool {
+	if len(pattern) != len(components) {
+		return false
+	}
+	for i := range pattern {
+		if !matchComponent(pattern[i], components[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchComponent reports whether a metric path component matches a rule pattern component, with carbon's glob semantics:
+// "*" matches any characters, "?" any single character, "[0-9]" or "[!abc]" a character of, or not of, the class,
+// and "{a,b*,c}" any of the comma separated alternatives, which may be nested.
+// Unbalanced braces & brackets match themselves.
+func matchComponent(pattern string, component string) bool {
+	if !strings.ContainsAny(pattern, globCharacters) {
+		return pattern == component
+	}
+
+	if open := strings.IndexByte(pattern, '{'); open != -1 {
+		if end, alternatives := braceAlternatives(pattern, open); end != -1 {
+			for _, alternative := range alternatives {
+				if matchComponent(pattern[:open]+alternative+pattern[end+1:], component) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return matchGlob(pattern, component)
+}
+
+// braceAlternatives returns the index of the brace closing the one at open, and the top-level comma separated alternatives
+// between them; or -1 if the brace is not closed.
+func braceAlternatives(pattern string, open int) (int, []string) {
+	var alternatives []string
+	depth := 0
+	start := open + 1
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[start:i])
+				start = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				return i, append(alternatives, pattern[start:i])
+			}
+		}
+	}
+	return -1, nil
+}
+
+// matchGlob reports whether the name matches the pattern of "*", "?" & "[...]" wildcards, braces being literal.
+// The last "*" is backtracked on mismatch, which is enough as any later match of a "*" can be reached from it.
+func matchGlob(pattern string, name string) bool {
+	patternIndex, nameIndex := 0, 0
+	starPattern, starName := -1, -1
+	for patternIndex < len(pattern) || nameIndex < len(name) {
+		if patternIndex < len(pattern) {
+			switch c := pattern[patternIndex]; c {
+			case '*':
+				starPattern, starName = patternIndex, nameIndex
+				patternIndex++
+				continue
+			case '?':
+				if nameIndex < len(name) {
+					patternIndex++
+					nameIndex++
+					continue
+				}
+			case '[':
+				if end := classEnd(pattern, patternIndex); end != -1 {
+					if nameIndex < len(name) && matchClass(pattern[patternIndex+1:end], name[nameIndex]) {
+						patternIndex = end + 1
+						nameIndex++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if nameIndex < len(name) && name[nameIndex] == c {
+					patternIndex++
+					nameIndex++
+					continue
+				}
+			}
+		}
+
+		// mismatch: let the last star match one more character
+		if starPattern != -1 && starName < len(name) {
+			starName++
+			patternIndex, nameIndex = starPattern+1, starName
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// classEnd returns the index of the bracket closing the character class opened at open, or -1 if it is not closed.
+// Like fnmatch, a "]" right after the opening bracket or its "!" negation is part of the class.
+func classEnd(pattern string, open int) int {
+	i := open + 1
+	if i < len(pattern) && pattern[i] == '!' {
+		i++
+	}
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	if end := strings.IndexByte(pattern[i:], ']'); end != -1 {
+		return i + end
+	}
+	return -1
+}
+
+// matchClass reports whether the character is one of the class, with its "a-z" ranges, or is not if the class starts with "!"
+func matchClass(class string, c byte) bool {
+	negated := len(class) > 0 && class[0] == '!'
+	if negated {
+		class = class[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(class) && !matched; i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			matched = class[i] <= c && c <= class[i+2]
+			i += 2
+		} else {
+			matched = class[i] == c
+		}
+	}
+	return matched != negated
+}
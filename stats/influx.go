@@ -0,0 +1,278 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PathTemplate maps an influx measurement, field & tags to a graphite path, as the telegraf graphite serializer.
+// It is a list of dot separated tokens:
+// - "measurement" is replaced by the measurement name,
+// - "field" is replaced by the field name, unless it is "value",
+// - "tags" is replaced by the values of all the tags not used elsewhere in the template, sorted by tag name,
+// - any other token is replaced by the value of the tag of that name, and skipped if the tag is absent.
+type PathTemplate []string
+
+// DefaultPathTemplate is used when no template is configured
+var DefaultPathTemplate = PathTemplate{"measurement", "field"}
+
+// pathComponentReplacer sanitizes the path components built from influx names & tags
+var pathComponentReplacer = strings.NewReplacer(".", "_", " ", "_")
+
+// ParsePathTemplate parses a dot separated PathTemplate, ex: "host.measurement.field"
+func ParsePathTemplate(template string) (PathTemplate, error) {
+	tokens := strings.Split(template, ".")
+	hasMeasurement := false
+	for _, token := range tokens {
+		if len(token) == 0 {
+			return nil, fmt.Errorf("empty token in path template `%v`", template)
+		}
+		if token == "measurement" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("path template `%v` must contain the measurement", template)
+	}
+	return PathTemplate(tokens), nil
+}
+
+// path builds the graphite path of a measurement field; dots & spaces of each component are replaced by underscores.
+func (template PathTemplate) path(measurement string, field string, tags map[string]string) string {
+	if len(template) == 0 {
+		template = DefaultPathTemplate
+	}
+
+	used := make(map[string]bool, len(template))
+	for _, token := range template {
+		used[token] = true
+	}
+
+	components := make([]string, 0, len(template)+len(tags))
+	for _, token := range template {
+		switch token {
+		case "measurement":
+			components = append(components, measurement)
+		case "field":
+			if field != "value" {
+				components = append(components, field)
+			}
+		case "tags":
+			keys := make([]string, 0, len(tags))
+			for k := range tags {
+				if !used[k] {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				components = append(components, tags[k])
+			}
+		default:
+			if value, ok := tags[token]; ok {
+				components = append(components, value)
+			}
+		}
+	}
+
+	for i, component := range components {
+		components[i] = pathComponentReplacer.Replace(component)
+	}
+	return strings.Join(components, ".")
+}
+
+// BuildMetricsFromInflux is retrieving Metrics from a received datapoint in the influx line protocol
+// "measurement,tag=value field=value,field2=value2 timestamp", one Metric per numeric field.
+// The path of each Metric is built with the given template, and influx tags are used as its tags.
+// String fields are skipped, booleans are converted to 0 or 1, and the reception time is used when no timestamp is given.
+func BuildMetricsFromInflux(datapoint Datapoint, template PathTemplate) ([]Metric, error) {
+	line := datapoint.Value
+
+	seriesEnd := indexUnescaped(line, ' ', false)
+	if seriesEnd == -1 {
+		return nil, newParseError(reasonMissingSpace, "Missing fields after influx measurement")
+	}
+	fieldsEnd := seriesEnd + 1 + indexUnescaped(line[seriesEnd+1:], ' ', true)
+	if fieldsEnd == seriesEnd {
+		fieldsEnd = len(line)
+	}
+
+	// Series: measurement & tags
+	series := splitUnescaped(line[:seriesEnd], ',', false)
+	measurement := unescapeInflux(series[0])
+	if len(measurement) == 0 {
+		return nil, newParseError(reasonEmptyPath, "Empty influx measurement")
+	}
+	influxTags := make(map[string]string, len(series)-1)
+	for _, tag := range series[1:] {
+		key, value, err := splitInfluxPair(tag)
+		if err != nil {
+			return nil, &ParseError{Reason: reasonInvalidTag, Err: err}
+		}
+		influxTags[key] = value
+	}
+	// path & tags of the datapoint, without field, for the errors of its timestamp & fields
+	path := template.path(measurement, "value", influxTags)
+	tags := make(map[string]string, len(datapoint.Tags)+len(influxTags))
+	for k, v := range datapoint.Tags {
+		tags[k] = v
+	}
+	for k, v := range influxTags {
+		tags[k] = v
+	}
+
+	// Timestamp, in nanoseconds
+	var timestamp uint64
+	if fieldsEnd < len(line) {
+		field := string(bytes.TrimSpace(line[fieldsEnd+1:]))
+		nanoseconds, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return nil, newPathParseError(reasonTimestampOutOfRange, path, tags, "Influx timestamp out of range: %v", field)
+			}
+			return nil, newPathParseError(reasonInvalidTimestamp, path, tags, "Invalid influx timestamp `%v`", field)
+		}
+		timestamp = uint64(nanoseconds / int64(time.Second))
+	} else if !datapoint.Timestamp.IsZero() {
+		timestamp = uint64(datapoint.Timestamp.Unix())
+	} else {
+		timestamp = uint64(time.Now().Unix())
+	}
+	if timestamp > 1<<32-1 {
+		return nil, newPathParseError(reasonTimestampOutOfRange, path, tags, "Influx timestamp out of range: %v", timestamp)
+	}
+
+	// Fields
+	var metrics []Metric
+	for _, field := range splitUnescaped(line[seriesEnd+1:fieldsEnd], ',', true) {
+		key, value, err := splitInfluxPair(field)
+		if err != nil {
+			return nil, newPathParseError(reasonInvalidField, path, tags, "%v", err)
+		}
+
+		fieldPath := template.path(measurement, key, influxTags)
+		fieldValue, numeric, err := influxFieldValue(value)
+		if err != nil {
+			reason := reasonNonNumericValue
+			if len(value) == 0 {
+				reason = reasonEmptyValue
+			}
+			return nil, newPathParseError(reason, fieldPath, tags, "Invalid influx field `%v`: %v", key, err)
+		}
+		if !numeric {
+			continue
+		}
+
+		metric := Metric{
+			Path:      fieldPath,
+			Tags:      make(map[string]string, len(tags)),
+			Timestamp: uint32(timestamp),
+			Value:     fieldValue,
+		}
+		for k, v := range tags {
+			metric.Tags[k] = v
+		}
+		metrics = append(metrics, metric)
+	}
+
+	if len(metrics) == 0 {
+		return nil, newPathParseError(reasonNoNumericField, path, tags, "No numeric influx field")
+	}
+	return metrics, nil
+}
+
+// influxFieldValue returns the graphite value of an influx field value, and whether it is numeric.
+func influxFieldValue(value string) (string, bool, error) {
+	if len(value) == 0 {
+		return "", false, errors.New("empty value")
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return "1", true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return "0", true, nil
+	}
+
+	switch value[len(value)-1] {
+	case '"':
+		if len(value) < 2 || value[0] != '"' {
+			return "", false, errors.New("unterminated string")
+		}
+		return "", false, nil
+	case 'i':
+		if _, err := strconv.ParseInt(value[:len(value)-1], 10, 64); err != nil {
+			return "", false, err
+		}
+		return value[:len(value)-1], true, nil
+	case 'u':
+		if _, err := strconv.ParseUint(value[:len(value)-1], 10, 64); err != nil {
+			return "", false, err
+		}
+		return value[:len(value)-1], true, nil
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// splitInfluxPair splits & unescapes an influx "key=value" pair.
+func splitInfluxPair(pair []byte) (string, string, error) {
+	index := indexUnescaped(pair, '=', false)
+	if index <= 0 {
+		return "", "", fmt.Errorf("Invalid influx key=value pair `%v`", string(pair))
+	}
+	return unescapeInflux(pair[:index]), unescapeInflux(pair[index+1:]), nil
+}
+
+// indexUnescaped returns the index of the first separator not escaped by a backslash,
+// and not within double quotes if quoted is set; -1 if none.
+func indexUnescaped(data []byte, separator byte, quoted bool) int {
+	inQuotes := false
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '\\':
+			i++
+		case quoted && data[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && data[i] == separator:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnescaped splits data around every separator not escaped by a backslash.
+func splitUnescaped(data []byte, separator byte, quoted bool) [][]byte {
+	var parts [][]byte
+	for {
+		index := indexUnescaped(data, separator, quoted)
+		if index == -1 {
+			return append(parts, data)
+		}
+		parts = append(parts, data[:index])
+		data = data[index+1:]
+	}
+}
+
+// unescapeInflux removes the backslashes escaping spaces, commas, equal signs & double quotes.
+func unescapeInflux(data []byte) string {
+	if bytes.IndexByte(data, '\\') == -1 {
+		return string(data)
+	}
+	var builder strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\\' && i+1 < len(data) && bytes.IndexByte([]byte(" ,=\""), data[i+1]) != -1 {
+			i++
+		}
+		builder.WriteByte(data[i])
+	}
+	return builder.String()
+}
@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	template, err := ParsePathTemplate("host.measurement.tags.field")
+	if err != nil || !reflect.DeepEqual(template, PathTemplate{"host", "measurement", "tags", "field"}) {
+		t.Errorf("failed to parse template: %v, %v", template, err)
+	}
+	for _, invalid := range []string{"", "host..measurement", "host.field"} {
+		if _, err := ParsePathTemplate(invalid); err == nil {
+			t.Errorf("parsing an invalid template should fail: `%v`", invalid)
+		}
+	}
+}
+
+func TestBuildMetricsFromInflux(t *testing.T) {
+	datapoint := Datapoint{Value: []byte("cpu,host=web01.dc1,cpu=cpu0 usage_idle=42.5,usage_user=3i,online=true,label=\"a b,c\" 1498887000000000000"), Tags: map[string]string{"host": "header", "appname": "testaroo"}}
+	metrics, err := BuildMetricsFromInflux(datapoint, nil)
+	if err != nil {
+		t.Fatalf("failed to build metrics from '%v': %v", string(datapoint.Value), err)
+	}
+	tags := map[string]string{"host": "web01.dc1", "cpu": "cpu0", "appname": "testaroo"}
+	expected := []Metric{
+		{Path: "cpu.usage_idle", Tags: tags, Timestamp: 1498887000, Value: "42.5"},
+		{Path: "cpu.usage_user", Tags: tags, Timestamp: 1498887000, Value: "3"},
+		{Path: "cpu.online", Tags: tags, Timestamp: 1498887000, Value: "1"},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("invalid metrics built:\nExp. %v\nGot: %v", expected, metrics)
+	}
+
+	template, _ := ParsePathTemplate("host.measurement.tags.field")
+	metrics, err = BuildMetricsFromInflux(Datapoint{Value: []byte("disk\\ io,host=web01.dc1,dc=par,dev=sda value=1 1498887000000000000")}, template)
+	if err != nil || len(metrics) != 1 || metrics[0].Path != "web01_dc1.disk_io.par.sda" {
+		t.Errorf("failed to build metric with template: %v, %v", metrics, err)
+	}
+
+	received := time.Unix(1498887, 0)
+	metrics, err = BuildMetricsFromInflux(Datapoint{Value: []byte("cpu value=1"), Timestamp: received}, nil)
+	if err != nil || len(metrics) != 1 || metrics[0].Timestamp != 1498887 || metrics[0].Path != "cpu" {
+		t.Errorf("failed to build metric without timestamp: %v, %v", metrics, err)
+	}
+
+	// integers are suffixed by i, unsigned integers by u
+	metrics, err = BuildMetricsFromInflux(Datapoint{Value: []byte("cpu big=18446744073709551615u,small=-9223372036854775808i 1498887000000000000")}, nil)
+	if err != nil || len(metrics) != 2 || metrics[0].Value != "18446744073709551615" || metrics[1].Value != "-9223372036854775808" {
+		t.Errorf("failed to build metrics of integer fields: %v, %v", metrics, err)
+	}
+
+	reasons := map[string]string{
+		"cpu value=-1u":                   "non_numeric_value",
+		"cpu value=18446744073709551616u": "non_numeric_value",
+		"cpu value=9223372036854775808i":  "non_numeric_value",
+		"cpu":                             "missing_space",
+		",host=a value=1":                 "empty_path",
+		"cpu,host value=1":                "invalid_tag",
+		"cpu value":                       "invalid_field",
+		"cpu value=abc":                   "non_numeric_value",
+		"cpu value=":                      "empty_value",
+		"cpu label=\"abc\"":               "no_numeric_field",
+		"cpu value=1 abc":                 "invalid_timestamp",
+		"cpu value=1 -1000000000":         "timestamp_out_of_range",
+		"cpu value=1 1e30":                "invalid_timestamp",
+		"cpu value=1 9999999999999999999": "timestamp_out_of_range",
+	}
+	for value, reason := range reasons {
+		if _, err := BuildMetricsFromInflux(Datapoint{Value: []byte(value)}, nil); err == nil || ErrorReason(err) != reason {
+			t.Errorf("building metrics from an invalid influx line '%v' should fail with reason %v: %v", value, reason, err)
+		}
+	}
+
+	var parseError *ParseError
+	_, err = BuildMetricsFromInflux(Datapoint{Value: []byte("cpu,host=web01 usage=abc"), Tags: map[string]string{"appname": "testaroo"}}, nil)
+	if !errors.As(err, &parseError) || parseError.Path != "cpu.usage" || parseError.Tags["host"] != "web01" || parseError.Tags["appname"] != "testaroo" {
+		t.Errorf("the error should contain the path & tags of the datapoint: %#v", err)
+	}
+}
+
+func TestProcessInflux(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "by-tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}, {Name: "start-by-app", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+			ComponentsNb: 3,
+		},
+		Format: FormatInflux,
+	}
+
+	if err := stats.Process(logger, Datapoint{Value: []byte("requests,appname=testaroo count=1,latency=2 1498887000000000000")}); err != nil {
+		t.Errorf("failed to process influx datapoint: %v", err)
+	}
+
+	metrics, _ := stats.BuildMetrics(Datapoint{Value: []byte("requests,appname=testaroo count=1 1498887000000000000")})
+	extractedMetric := stats.getMetric(logger, metrics[0].Path, metrics[0].Tags)
+	if extractedMetric.ApplicationName != "testaroo" || extractedMetric.ExtractedMetric != "requests.count" {
+		t.Errorf("tag rule should match influx tags: %v", extractedMetric)
+	}
+}
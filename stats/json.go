@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// jsonDatapoint is a datapoint in the json format; fields are decoded separately to report precise errors.
+type jsonDatapoint struct {
+	Path      json.RawMessage `json:"path"`
+	Value     json.RawMessage `json:"value"`
+	Timestamp json.RawMessage `json:"timestamp"`
+	Tags      json.RawMessage `json:"tags"`
+}
+
+// BuildMetricFromJSON is retrieving a Metric from a received datapoint in the json format
+// {"path": "foo.bar", "value": 42, "timestamp": 1498887, "tags": {"appname": "testaroo"}}.
+// Tags of the tags object take precedence over the datapoint ones, and tags of a tagged series path over both.
+func BuildMetricFromJSON(datapoint Datapoint) (Metric, error) {
+	metric := Metric{}
+	metric.Tags = make(map[string]string, 0)
+
+	var document jsonDatapoint
+	if err := json.Unmarshal(datapoint.Value, &document); err != nil {
+		return metric, &ParseError{Reason: reasonJSONSyntax, Err: err}
+	}
+
+	for k, v := range datapoint.Tags {
+		metric.Tags[k] = v
+	}
+	if !isJSONNull(document.Tags) {
+		var tags map[string]string
+		if err := json.Unmarshal(document.Tags, &tags); err != nil {
+			return metric, &ParseError{Reason: reasonJSONInvalidTags, Err: err}
+		}
+		for k, v := range tags {
+			metric.Tags[k] = v
+		}
+	}
+
+	// Path
+	if isJSONNull(document.Path) {
+		return metric, newParseError(reasonJSONMissingPath, "Missing path in json datapoint")
+	}
+	var path string
+	if err := json.Unmarshal(document.Path, &path); err != nil || len(path) == 0 {
+		return metric, newParseError(reasonJSONInvalidPath, "Invalid path in json datapoint")
+	}
+	path, err := SplitTaggedPath(path, metric.Tags)
+	if err != nil {
+		return metric, &ParseError{Reason: reasonJSONInvalidPath, Err: err}
+	}
+	metric.Path = path
+
+	// Value, as a json number or a string
+	if isJSONNull(document.Value) {
+		return metric, newPathParseError(reasonJSONMissingValue, metric.Path, metric.Tags, "Missing value in json datapoint")
+	}
+	var value json.Number
+	if err := json.Unmarshal(document.Value, &value); err != nil {
+		return metric, &ParseError{Reason: reasonJSONInvalidValue, Err: err, Path: metric.Path, Tags: metric.Tags}
+	}
+	if _, err := value.Float64(); err != nil {
+		return metric, &ParseError{Reason: reasonJSONInvalidValue, Err: err, Path: metric.Path, Tags: metric.Tags}
+	}
+	metric.Value = value.String()
+
+	// Timestamp, in seconds
+	if isJSONNull(document.Timestamp) {
+		return metric, newPathParseError(reasonJSONMissingTimestamp, metric.Path, metric.Tags, "Missing timestamp in json datapoint")
+	}
+	timestamp, err := strconv.ParseUint(string(document.Timestamp), 10, 32)
+	if err != nil {
+		return metric, &ParseError{Reason: reasonJSONInvalidTimestamp, Err: err, Path: metric.Path, Tags: metric.Tags}
+	}
+	metric.Timestamp = uint32(timestamp)
+
+	return metric, nil
+}
+
+// isJSONNull returns true for absent or null json values
+func isJSONNull(value json.RawMessage) bool {
+	return len(value) == 0 || bytes.Equal(value, []byte("null"))
+}
+
+// isJSONMessage returns true if the message is a json document
+func isJSONMessage(message []byte) bool {
+	message = bytes.TrimSpace(message)
+	return len(message) > 0 && (message[0] == '{' || message[0] == '[')
+}
+
+// splitJSONDocuments returns every json datapoint of a message: either an array of datapoints,
+// or one or more concatenated datapoints.
+func splitJSONDocuments(message []byte) ([][]byte, error) {
+	var documents [][]byte
+
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	for decoder.More() {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err != nil {
+			return nil, &ParseError{Reason: reasonJSONSyntax, Err: err}
+		}
+
+		if len(document) > 0 && document[0] == '[' {
+			var array []json.RawMessage
+			if err := json.Unmarshal(document, &array); err != nil {
+				return nil, &ParseError{Reason: reasonJSONSyntax, Err: err}
+			}
+			for _, item := range array {
+				documents = append(documents, item)
+			}
+		} else {
+			documents = append(documents, document)
+		}
+	}
+
+	if len(documents) == 0 {
+		return nil, newParseError(reasonJSONSyntax, "No json datapoint in message")
+	}
+	return documents, nil
+}
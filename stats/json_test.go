@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBuildMetricFromJSON(t *testing.T) {
+	datapoint := Datapoint{
+		Value: []byte(`{"path": "foo.bar;server=web01", "value": 42.5, "timestamp": 1498887, "tags": {"appname": "testaroo", "server": "tags"}}`),
+		Tags:  map[string]string{"appname": "header", "dc": "dc1"},
+	}
+	metric, err := BuildMetricFromJSON(datapoint)
+	if err != nil {
+		t.Errorf("failed to build metric from '%v': %v", string(datapoint.Value), err)
+	}
+	expected := Metric{
+		Path:      "foo.bar",
+		Tags:      map[string]string{"appname": "testaroo", "server": "web01", "dc": "dc1"},
+		Timestamp: 1498887,
+		Value:     "42.5",
+	}
+	if !reflect.DeepEqual(metric, expected) {
+		t.Errorf("invalid metric built:\nExp. %v\nGot: %v", expected, metric)
+	}
+
+	metric, err = BuildMetricFromJSON(Datapoint{Value: []byte(`{"path": "foo.bar", "value": "12", "timestamp": 1498887}`)})
+	if err != nil || metric.Value != "12" {
+		t.Errorf("failed to build metric with a string value: %v, %v", metric, err)
+	}
+
+	reasons := map[string]string{
+		`{"path": "foo.bar", "value": 1, "timestamp": 1498887`:                    "json_syntax",
+		`["foo.bar", 1, 1498887]`:                                                 "json_syntax",
+		`{"value": 1, "timestamp": 1498887}`:                                      "json_missing_path",
+		`{"path": 12, "value": 1, "timestamp": 1498887}`:                          "json_invalid_path",
+		`{"path": "", "value": 1, "timestamp": 1498887}`:                          "json_invalid_path",
+		`{"path": "foo.bar", "timestamp": 1498887}`:                               "json_missing_value",
+		`{"path": "foo.bar", "value": "abc", "timestamp": 1498887}`:               "json_invalid_value",
+		`{"path": "foo.bar", "value": 1}`:                                         "json_missing_timestamp",
+		`{"path": "foo.bar", "value": 1, "timestamp": -1}`:                        "json_invalid_timestamp",
+		`{"path": "foo.bar", "value": 1, "timestamp": "1498887"}`:                 "json_invalid_timestamp",
+		`{"path": "foo.bar", "value": 1, "timestamp": 1498887, "tags": {"a": 1}}`: "json_invalid_tags",
+	}
+	for value, reason := range reasons {
+		_, err := BuildMetricFromJSON(Datapoint{Value: []byte(value)})
+		if err == nil || ErrorReason(err) != reason {
+			t.Errorf("building metric from '%v' should fail with reason %v: %v", value, reason, err)
+		}
+	}
+}
+
+func TestProcessJSONMessage(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "start-by-app", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+			ComponentsNb: 3,
+		},
+		TopicFormats: map[string]Format{"metrics-json": FormatJSON},
+	}
+
+	messages := []string{
+		`{"path": "foo.bar", "value": 1, "timestamp": 1498887}`,
+		"{\"path\": \"foo.bar\", \"value\": 1, \"timestamp\": 1498887}\n{\"path\": \"foo.baz\",\n \"value\": 2, \"timestamp\": 1498887}",
+		`[{"path": "foo.bar", "value": 1, "timestamp": 1498887}, {"path": "foo.baz", "value": 2, "timestamp": 1498887}]`,
+	}
+	for _, message := range messages {
+		if err := stats.ProcessMessage(logger, Datapoint{Value: []byte(message), Source: "metrics-json"}); err != nil {
+			t.Errorf("failed to process json message '%v': %v", message, err)
+		}
+	}
+
+	message := Datapoint{Value: []byte(`[{"path": "foo.bar", "value": 1, "timestamp": 1498887}, {"path": "foo.baz", "timestamp": 1498887}]`), Source: "metrics-json"}
+	messageError, ok := stats.ProcessMessage(logger, message).(*MessageError)
+	if !ok || len(messageError.Lines) != 1 || ErrorReason(messageError.Lines[0].Err) != "json_missing_value" {
+		t.Errorf("invalid json datapoints should be reported: %v", messageError)
+	}
+
+	message = Datapoint{Value: []byte(`{"path": "foo.bar", "value": 1,`), Source: "metrics-json"}
+	messageError, ok = stats.ProcessMessage(logger, message).(*MessageError)
+	if !ok || len(messageError.Lines) != 1 || ErrorReason(messageError.Lines[0].Err) != "json_syntax" {
+		t.Errorf("malformed json message should be reported: %v", messageError)
+	}
+
+	// other topics still use the plaintext format
+	if err := stats.ProcessMessage(logger, Datapoint{Value: []byte("foo.bar 1 1498887"), Source: "metrics"}); err != nil {
+		t.Errorf("failed to process plaintext message: %v", err)
+	}
+}
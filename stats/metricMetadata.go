@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"errors"
 	"go.uber.org/zap"
 	"strings"
 )
@@ -12,10 +13,14 @@ type MetricMetadata struct {
 }
 
 // ExtractedMetric will be filled with with AplicationName, Type & rebuilt MetricPath from matching rule.
+// Fields are the values of the named groups of a matching regex rule, other than the application;
+// LabelFields are the ones exported as labels, see Rule.LabelFields.
 type ExtractedMetric struct {
 	ExtractedMetric string
 	ApplicationName string
 	ApplicationType string
+	Fields          map[string]string
+	LabelFields     []string
 }
 
 // Extract from the metric the application name if possible based on loaded rules
@@ -24,23 +29,98 @@ type ExtractedMetric struct {
 // - Run rules
 // - Build & return the ExtractMetric structure
 func (stats *Stats) getMetric(logger *zap.Logger, metricPath string, metricTags map[string]string) ExtractedMetric {
+	statsMetric, err := stats.classify(metricPath, metricTags)
+	logClassificationError(logger, metricPath, err)
+	return statsMetric
+}
+
+// classify extracts the application of the metric like getMetric, without logging.
+// If no application could be extracted, it returns a ParseError with the reason & the matching rule if any.
+func (stats *Stats) classify(metricPath string, metricTags map[string]string) (ExtractedMetric, *ParseError) {
 	statsMetric := ExtractedMetric{ExtractedMetric: "None", ApplicationName: "None", ApplicationType: "None"}
 	components := getComponents(metricPath, stats.MetricMetadata.ComponentsNb)
-	rule := getRule(components, metricTags, stats.MetricMetadata.Rules)
+	rule, submatches := getRule(metricPath, components, metricTags, stats.MetricMetadata.Rules)
 	if rule.Name == "" {
-		logger.Warn("Metric Path did not match any rules", zap.String("metricPath", metricPath))
+		err := newPathParseError(reasonNoMatchingRule, metricPath, metricTags, "Metric Path did not match any rules")
+		err.Application, err.ApplicationType = "None", "None"
+		return statsMetric, err
+	} else if rule.regex != nil {
+		return extractRegexMetric(statsMetric, metricPath, metricTags, components, rule, submatches)
 	} else if int(rule.ApplicationNamePosition) < len(components) {
 		statsMetric.ApplicationType = rule.Name // rule.Name is check in rules.go
-		if tag, hasTag := getMatchingTag(metricTags, rule); hasTag {
+		if len(rule.ApplicationTag) > 0 {
+			statsMetric.ApplicationName = metricTags[rule.ApplicationTag]
+		} else if tag, hasTag := getMatchingTag(metricTags, rule); hasTag {
 			statsMetric.ApplicationName = metricTags[tag]
 		} else {
 			statsMetric.ApplicationName = components[rule.ApplicationNamePosition] // the ApplicationNamePosition is check in rules.go ( must be > 0 )
 		}
 		statsMetric.ExtractedMetric = strings.Join(components, ".")
+		return statsMetric, nil
+	}
+
+	err := newPathParseError(reasonApplicationPosition, metricPath, metricTags, "bad metric")
+	err.Application, err.ApplicationType = "None", rule.Name
+	return statsMetric, err
+}
+
+// extractRegexMetric fills the application & fields of a metric matching a regex rule from the named groups submatches
+func extractRegexMetric(statsMetric ExtractedMetric, metricPath string, metricTags map[string]string, components []string, rule Rule, submatches []string) (ExtractedMetric, *ParseError) {
+	for i, name := range rule.regex.SubexpNames() {
+		if name == applicationGroup {
+			statsMetric.ApplicationName = submatches[i]
+		} else if name != "" && submatches[i] != "" {
+			if statsMetric.Fields == nil {
+				statsMetric.Fields = make(map[string]string)
+			}
+			statsMetric.Fields[name] = submatches[i]
+		}
+	}
+	if len(rule.ApplicationTag) > 0 {
+		statsMetric.ApplicationName = metricTags[rule.ApplicationTag]
+	}
+	if statsMetric.ApplicationName == "" {
+		err := newPathParseError(reasonEmptyApplication, metricPath, metricTags, "empty application captured by rule `%v`", rule.Name)
+		err.Application, err.ApplicationType = "None", rule.Name
+		return ExtractedMetric{ExtractedMetric: "None", ApplicationName: "None", ApplicationType: "None"}, err
+	}
+
+	statsMetric.ApplicationType = rule.Name
+	statsMetric.ExtractedMetric = strings.Join(components, ".")
+	statsMetric.LabelFields = rule.LabelFields
+	return statsMetric, nil
+}
+
+// logClassificationError logs why the application of the metric could not be extracted, if so
+func logClassificationError(logger *zap.Logger, metricPath string, err *ParseError) {
+	if err == nil {
+		return
+	}
+	if err.Reason == reasonNoMatchingRule {
+		logger.Warn("Metric Path did not match any rules", zap.String("metricPath", metricPath))
 	} else {
-		logger.Error("bad metric ", zap.String("metricPath", metricPath), zap.String("rule", rule.Name))
+		logger.Error("bad metric ", zap.String("metricPath", metricPath), zap.String("rule", err.ApplicationType))
 	}
-	return statsMetric
+}
+
+// errorApplication returns the application & its type of an invalid datapoint, or None as for unclassified datapoints if unknown
+func (stats *Stats) errorApplication(err error) (string, string) {
+	var parseError *ParseError
+	if !errors.As(err, &parseError) {
+		return "None", "None"
+	}
+	if parseError.ApplicationType != "" {
+		return parseError.Application, parseError.ApplicationType
+	}
+	if parseError.Path == "" {
+		return "None", "None"
+	}
+
+	statsMetric, classifyError := stats.classify(parseError.Path, parseError.Tags)
+	if classifyError != nil {
+		return classifyError.Application, classifyError.ApplicationType
+	}
+	return statsMetric.ApplicationName, statsMetric.ApplicationType
 }
 
 // getComponents splits a metricPath according to the given componentsLen
@@ -80,44 +160,52 @@ func getMatchingTag(tags map[string]string, rule Rule) (string, bool) {
 }
 
 func isMatchingRule(components []string, tags map[string]string, rule Rule) bool {
-	_, match := getMatchingTag(tags, rule)
-
-	// If rule is a tag rule, skip path component test.
+	// If rule is a tag rule, the metric must have one of its tags; a composite rule must match its pattern too.
 	if 0 != len(rule.UseTags) {
-		return match
+		if _, match := getMatchingTag(tags, rule); !match {
+			return false
+		}
 	}
 
 	patternLen := len(rule.Pattern)
-	if patternLen == 0 {
-		match = true
-	} else if len(components) >= patternLen && patternLen > 0 {
-		extractedComponent := components[0:patternLen]
-		match = cheapEqual(rule.Pattern, extractedComponent)
+	if len(components) < patternLen {
+		return false
 	}
-	return match
+	return matchPattern(rule.Pattern, components[0:patternLen])
 }
 
-func cheapEqual(array1 []string, array2 []string) bool {
-	equals := false
-	if len(array2) == len(array1) {
-		i := 0
-		for ; i < len(array1) && array1[i] == array2[i]; i++ {
-
+// getRule returns the first rule matching the metric, and the submatches of its regex if it is a regex rule
+func getRule(metricPath string, components []string, metricTags map[string]string, allRules Rules) (Rule, []string) {
+	if allRules.index != nil {
+		if i, submatches := allRules.index.match(metricPath, components, metricTags); i != noRule {
+			return allRules.Rules[i], submatches
 		}
-		if i == len(array1) {
-			equals = true
+		return Rule{}, nil
+	}
+	return scanRules(metricPath, components, metricTags, allRules.Rules)
+}
+
+// scanRules returns the first rule matching the metric like getRule, trying all the rules in order
+func scanRules(metricPath string, components []string, metricTags map[string]string, allRules []Rule) (Rule, []string) {
+	for _, rule := range allRules {
+		if match, submatches := matchRule(metricPath, components, metricTags, rule); match {
+			return rule, submatches
 		}
 	}
-	return equals
+	return Rule{}, nil
 }
 
-func getRule(components []string, metricTags map[string]string, allRules Rules) Rule {
-	i := 0
-	var rule Rule
-	for ; i < len(allRules.Rules) && !isMatchingRule(components, metricTags, allRules.Rules[i]); i++ {
+// matchRule reports whether the metric matches the rule & its tag conditions, with the submatches of its regex if it is a regex rule
+func matchRule(metricPath string, components []string, metricTags map[string]string, rule Rule) (bool, []string) {
+	if !matchTagConditions(metricTags, rule) {
+		return false, nil
 	}
-	if i < len(allRules.Rules) {
-		rule = allRules.Rules[i]
+	if len(rule.Regex) > 0 {
+		if rule.regex == nil {
+			return false, nil
+		}
+		submatches := rule.regex.FindStringSubmatch(metricPath)
+		return submatches != nil, submatches
 	}
-	return rule
+	return isMatchingRule(components, metricTags, rule), nil
 }
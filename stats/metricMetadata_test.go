@@ -7,35 +7,39 @@ import (
 	"go.uber.org/zap/zaptest"
 )
 
-func TestCheapEquals(t *testing.T) {
-	isEquals := cheapEqual([]string{"a"}, []string{"a"})
+func TestMatchPattern(t *testing.T) {
+	isEquals := matchPattern([]string{"a"}, []string{"a"})
 	if !isEquals {
 		t.Error("array should be equals ")
 	}
-	isEquals = cheapEqual([]string{"a"}, []string{"b"})
+	isEquals = matchPattern([]string{"a"}, []string{"b"})
 	if isEquals {
 		t.Error("array should not be equals ")
 	}
-	isEquals = cheapEqual([]string{"a"}, nil)
+	isEquals = matchPattern([]string{"a"}, nil)
 	if isEquals {
 		t.Error("array should not be equals ")
 	}
-	isEquals = cheapEqual(nil, []string{"a"})
+	isEquals = matchPattern(nil, []string{"a"})
 	if isEquals {
 		t.Error("array should not be equals ")
 	}
-	isEquals = cheapEqual(nil, nil)
+	isEquals = matchPattern(nil, nil)
 	if !isEquals {
 		t.Error("array should  be equals ")
 	}
+	isEquals = matchPattern([]string{"foo", "aggreg*"}, []string{"foo", "aggregated"})
+	if !isEquals {
+		t.Error("glob array should match")
+	}
 }
 func TestIsMatchingRule(t *testing.T) {
-	rule := Rule{"aggreg", []string{}, []string{"foo", "aggreg"}, 2}
+	rule := Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
 	isMatchedRule := isMatchingRule([]string{"foo", "aggreg", "d"}, map[string]string{}, rule)
 	if !isMatchedRule {
 		t.Error("should match the rule but for now it doesn't ")
 	}
-	rule = Rule{"aggreg", []string{}, []string{"foo", "anotheraggr"}, 2}
+	rule = Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "anotheraggr"}, ApplicationNamePosition: 2}
 	isMatchedRule = isMatchingRule([]string{"foo", "aggreg", "d"}, map[string]string{}, rule)
 	if isMatchedRule {
 		t.Error("should not match the rule but for now it doesn't ")
@@ -46,7 +50,7 @@ func TestIsMatchingRule(t *testing.T) {
 		t.Error("should match as pattern len equals 0 ! ")
 	}
 
-	ruleTags := Rule{"tag", []string{"appname"}, []string{}, 1}
+	ruleTags := Rule{Name: "tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 1}
 	isMatchedRule = isMatchingRule([]string{"foo", "aggreg", "d"}, map[string]string{"foo": "bar"}, ruleTags)
 	if isMatchedRule {
 		t.Error("rule tags should not match")
@@ -91,14 +95,14 @@ func TestGetComponents(t *testing.T) {
 }
 
 func TestGetRule(t *testing.T) {
-	aggregRule := Rule{"aggreg", []string{}, []string{"foo", "aggreg"}, 2}
-	anotheraggrRule := Rule{"anotheraggr", []string{}, []string{"foo", "anotheraggr"}, 2}
-	aggregAllRule := Rule{"aggreg-all", []string{}, []string{"foo", "aggreg-all"}, 2}
-	legacybarRule := Rule{"legacy-bar", []string{}, []string{"prometheus", "bar"}, 1}
-	startWithCriteoRule := Rule{"start-by-foo", []string{}, []string{"foo"}, 1}
-	startbyAppRule := Rule{"start-by-app", []string{}, nil, 0}
+	aggregRule := Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
+	anotheraggrRule := Rule{Name: "anotheraggr", UseTags: []string{}, Pattern: []string{"foo", "anotheraggr"}, ApplicationNamePosition: 2}
+	aggregAllRule := Rule{Name: "aggreg-all", UseTags: []string{}, Pattern: []string{"foo", "aggreg-all"}, ApplicationNamePosition: 2}
+	legacybarRule := Rule{Name: "legacy-bar", UseTags: []string{}, Pattern: []string{"prometheus", "bar"}, ApplicationNamePosition: 1}
+	startWithCriteoRule := Rule{Name: "start-by-foo", UseTags: []string{}, Pattern: []string{"foo"}, ApplicationNamePosition: 1}
+	startbyAppRule := Rule{Name: "start-by-app", UseTags: []string{}, Pattern: nil, ApplicationNamePosition: 0}
 	rules := Rules{Rules: []Rule{aggregRule, anotheraggrRule, aggregAllRule, legacybarRule, startWithCriteoRule, startbyAppRule}}
-	rule := getRule([]string{"foo", "aggreg", "myapp"}, map[string]string{}, rules)
+	rule, _ := getRule("foo.aggreg.myapp", []string{"foo", "aggreg", "myapp"}, map[string]string{}, rules)
 	if rule.Name != aggregRule.Name {
 		t.Error("should be an aggreg metric")
 	}
@@ -108,9 +112,9 @@ func TestLegacyAndTags(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 
 	metric := Metric{Path: "a.b.c.d", Tags: map[string]string{"foo": "bar", "appname": "testaroo"}}
-	rule := Rule{"rule-name", []string{"appname"}, []string{}, 0}
-	rule1 := Rule{"rule-pb", []string{}, []string{"appname"}, 1}
-	ruleLast := Rule{"last-rule", []string{}, []string{}, 0}
+	rule := Rule{Name: "rule-name", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}
+	rule1 := Rule{Name: "rule-pb", UseTags: []string{}, Pattern: []string{"appname"}, ApplicationNamePosition: 1}
+	ruleLast := Rule{Name: "last-rule", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}
 
 	stats := Stats{MetricMetadata: MetricMetadata{
 		Rules:        Rules{Rules: []Rule{rule, rule1, ruleLast}},
@@ -138,3 +142,162 @@ func TestLegacyAndTags(t *testing.T) {
 	}
 
 }
+
+func TestMatchComponent(t *testing.T) {
+	matches := []struct {
+		pattern   string
+		component string
+		match     bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "fo", false},
+		{"*", "anything", true},
+		{"*", "", true},
+		{"aggreg*", "aggregated", true},
+		{"aggreg*", "aggreg", true},
+		{"aggreg*", "agg", false},
+		{"*ated", "aggregated", true},
+		{"a*g*d", "aggregated", true},
+		{"a*x*d", "aggregated", false},
+		{"host?", "host1", true},
+		{"host?", "host12", false},
+		{"{foo,bar,baz}", "bar", true},
+		{"{foo,bar,baz}", "qux", false},
+		{"app-{web,db*}", "app-dbmaster", true},
+		{"{a,{b,c}d}", "cd", true},
+		{"{a,{b,c}d}", "c", false},
+		{"{}", "", true},
+		{"{foo", "{foo", true},
+		{"{foo", "foo", false},
+		{"dc[0-9]", "dc4", true},
+		{"dc[0-9]", "dcx", false},
+		{"dc[!0-9]", "dcx", true},
+		{"dc[!0-9]", "dc4", false},
+		{"[]a]", "]", true},
+		{"[abc", "[abc", true},
+		{"web[0-9][0-9]-{eu,us}*", "web42-us-east", true},
+	}
+	for _, match := range matches {
+		if matchComponent(match.pattern, match.component) != match.match {
+			t.Errorf("Matching `%v` against `%v` should be %v", match.component, match.pattern, match.match)
+		}
+	}
+}
+
+func TestRegexRuleClassification(t *testing.T) {
+	rules := Rules{Rules: []Rule{
+		{Name: "svc", Regex: `svc-(?P<app>[a-z]*)_(?P<env>[a-z]+)(?:\.(?P<unit>ms|s))?\..*`, LabelFields: []string{"env"}},
+		{Name: "unchecked", Regex: `(?P<app>.*)`},
+		{Name: "start-by-app", ApplicationNamePosition: 0},
+	}}
+	if err := CheckRules(Rules{Rules: rules.Rules[:1]}); err != nil {
+		t.Fatalf("failed to check rules: %v", err)
+	}
+	stats := Stats{MetricMetadata: MetricMetadata{Rules: rules, ComponentsNb: 2}}
+
+	metrics := map[string]ExtractedMetric{
+		"svc-foo_prod.requests":       {ExtractedMetric: "svc-foo_prod.requests", ApplicationName: "foo", ApplicationType: "svc", Fields: map[string]string{"env": "prod"}, LabelFields: []string{"env"}},
+		"svc-foo_dev.ms.latency.p99":  {ExtractedMetric: "svc-foo_dev.ms", ApplicationName: "foo", ApplicationType: "svc", Fields: map[string]string{"env": "dev", "unit": "ms"}, LabelFields: []string{"env"}},
+		"other.svc-foo_prod.requests": {ExtractedMetric: "other.svc-foo_prod", ApplicationName: "other", ApplicationType: "start-by-app"},
+	}
+	for path, expected := range metrics {
+		if extractedMetric, err := stats.classify(path, nil); err != nil || !reflect.DeepEqual(extractedMetric, expected) {
+			t.Errorf("invalid extracted metric from `%v`: %v\nExp. %v\nGot: %v", path, err, expected, extractedMetric)
+		}
+	}
+
+	if _, err := stats.classify("svc-_prod.requests", nil); err == nil || err.Reason != reasonEmptyApplication || err.ApplicationType != "svc" {
+		t.Errorf("an empty application capture should be an error, got %v", err)
+	}
+
+	// only the label fields are exported, other fields having unbounded values
+	envLabels := map[string]string{"field": "env", "value": "dev", "application": "foo", "application_type": "svc"}
+	unitLabels := map[string]string{"field": "unit", "value": "ms", "application": "foo", "application_type": "svc"}
+	envBefore := gatheredValue(t, "metrics_rule_fields_total", envLabels)
+	stats.ProcessMetric(zaptest.NewLogger(t), Metric{Path: "svc-foo_dev.ms.latency.p99", Value: "1", Timestamp: 1500000000}, Datapoint{})
+	if env := gatheredValue(t, "metrics_rule_fields_total", envLabels) - envBefore; env != 1 {
+		t.Errorf("the env label field should be counted once, got %v", env)
+	}
+	if unit := gatheredValue(t, "metrics_rule_fields_total", unitLabels); unit != 0 {
+		t.Errorf("the unit field should not be exported, got %v", unit)
+	}
+}
+
+func TestTagConditionClassification(t *testing.T) {
+	rules := Rules{Rules: []Rule{
+		{Name: "prod-teams", TagConditions: []TagCondition{{Tag: "env", Equals: "prod"}, {Tag: "team"}}, ApplicationTag: "team"},
+		{Name: "services", TagConditions: []TagCondition{{Tag: "application", Regex: "^svc-.*"}}, ApplicationTag: "application"},
+		{Name: "staging", TagConditions: []TagCondition{{Tag: "env", In: []string{"staging", "preprod"}}}, UseTags: []string{"appname"}},
+		{Name: "untagged-aggreg", TagConditions: []TagCondition{{Tag: "appname", Absent: true}}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2},
+		{Name: "by-tag", UseTags: []string{"appname"}},
+		{Name: "start-by-app"},
+	}}
+	if err := CheckRules(rules); err != nil {
+		t.Fatalf("failed to check rules: %v", err)
+	}
+
+	metrics := []struct {
+		path     string
+		tags     map[string]string
+		expected string
+	}{
+		{"a.b", map[string]string{"env": "prod", "team": "billing", "appname": "api"}, "prod-teams/billing"},
+		{"a.b", map[string]string{"env": "dev", "team": "billing", "appname": "api"}, "by-tag/api"},
+		{"a.b", map[string]string{"env": "prod"}, "start-by-app/a"},
+		{"a.b", map[string]string{"application": "svc-payments"}, "services/svc-payments"},
+		{"a.b", map[string]string{"application": "legacy-svc-payments"}, "start-by-app/a"},
+		{"a.b", map[string]string{"env": "preprod", "appname": "api"}, "staging/api"},
+		{"a.b", map[string]string{"env": "qa", "appname": "api"}, "by-tag/api"},
+		{"foo.aggreg.myapp", nil, "untagged-aggreg/myapp"},
+		{"foo.aggreg.myapp", map[string]string{"appname": "api"}, "by-tag/api"},
+	}
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			rules.index = newRuleIndex(rules.Rules)
+		}
+		stats := Stats{MetricMetadata: MetricMetadata{Rules: rules, ComponentsNb: 3}}
+		for _, metric := range metrics {
+			extractedMetric, err := stats.classify(metric.path, metric.tags)
+			if got := extractedMetric.ApplicationType + "/" + extractedMetric.ApplicationName; err != nil || got != metric.expected {
+				t.Errorf("invalid classification of `%v` %v (indexed: %v): %v, exp. %v got %v", metric.path, metric.tags, indexed, err, metric.expected, got)
+			}
+		}
+	}
+}
+
+func TestCompositeRuleClassification(t *testing.T) {
+	rules := Rules{Rules: []Rule{
+		{Name: "relay", UseTags: []string{"source"}, Pattern: []string{"foo", "aggregated"}},
+		{Name: "relay2", TagConditions: []TagCondition{{Tag: "source", Equals: "relay2"}}, Pattern: []string{"bar", "aggregated"}, ApplicationNamePosition: 2},
+		{Name: "by-tag", UseTags: []string{"appname"}},
+		{Name: "start-by-app"},
+	}}
+	if err := CheckRules(rules); err != nil {
+		t.Fatalf("failed to check rules: %v", err)
+	}
+
+	metrics := []struct {
+		path     string
+		tags     map[string]string
+		expected string
+	}{
+		{"foo.aggregated.myapp", map[string]string{"source": "relay1"}, "relay/relay1"},
+		{"foo.aggregated.myapp", map[string]string{"appname": "api"}, "by-tag/api"},
+		{"foo.other.myapp", map[string]string{"source": "relay1"}, "start-by-app/foo"},
+		{"foo", map[string]string{"source": "relay1"}, "start-by-app/foo"},
+		{"bar.aggregated.myapp", map[string]string{"source": "relay2"}, "relay2/myapp"},
+		{"bar.aggregated.myapp", map[string]string{"source": "relay1"}, "start-by-app/bar"},
+	}
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			rules.index = newRuleIndex(rules.Rules)
+		}
+		stats := Stats{MetricMetadata: MetricMetadata{Rules: rules, ComponentsNb: 3}}
+		for _, metric := range metrics {
+			extractedMetric, err := stats.classify(metric.path, metric.tags)
+			if got := extractedMetric.ApplicationType + "/" + extractedMetric.ApplicationName; err != nil || got != metric.expected {
+				t.Errorf("invalid classification of `%v` %v (indexed: %v): %v, exp. %v got %v", metric.path, metric.tags, indexed, err, metric.expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// BuildMetricFromOpenTSDB is retrieving a Metric from a received datapoint in the OpenTSDB telnet format
+// "put metric timestamp value tag1=value1 tag2=value2"; the metric name is used as the path, and k=v pairs as tags.
+// Timestamps may be in seconds or milliseconds.
+func BuildMetricFromOpenTSDB(datapoint Datapoint) (Metric, error) {
+	metric := Metric{}
+	metric.Tags = make(map[string]string, 0)
+
+	fields := bytes.Fields(datapoint.Value)
+	if len(fields) == 0 || string(fields[0]) != "put" {
+		return metric, newParseError(reasonMissingCommand, "Missing put command")
+	}
+	if len(fields) < 2 {
+		return metric, newParseError(reasonEmptyPath, "Missing metric name")
+	}
+
+	for k, v := range datapoint.Tags {
+		metric.Tags[k] = v
+	}
+	metric.Path = string(fields[1])
+
+	if len(fields) < 4 {
+		return metric, newPathParseError(reasonMissingTimestamp, metric.Path, metric.Tags, "Missing timestamp or value")
+	}
+	for _, tag := range fields[4:] {
+		indexEqual := bytes.IndexByte(tag, '=')
+		if indexEqual <= 0 || indexEqual == len(tag)-1 {
+			return metric, newPathParseError(reasonInvalidTag, metric.Path, metric.Tags, "Invalid tag `%v`", string(tag))
+		}
+		metric.Tags[string(tag[:indexEqual])] = string(tag[indexEqual+1:])
+	}
+
+	timestamp, err := strconv.ParseUint(string(fields[2]), 10, 64)
+	if err != nil {
+		if _, intErr := strconv.ParseInt(string(fields[2]), 10, 64); intErr == nil || errors.Is(err, strconv.ErrRange) {
+			return metric, newPathParseError(reasonTimestampOutOfRange, metric.Path, metric.Tags, "OpenTSDB timestamp out of range: %v", string(fields[2]))
+		}
+		return metric, newPathParseError(reasonInvalidTimestamp, metric.Path, metric.Tags, "Invalid OpenTSDB timestamp `%v`", string(fields[2]))
+	}
+	// OpenTSDB timestamps with more than 10 digits are in milliseconds
+	if timestamp > 9999999999 {
+		timestamp /= 1000
+	}
+	if timestamp > 1<<32-1 {
+		return metric, newPathParseError(reasonTimestampOutOfRange, metric.Path, metric.Tags, "OpenTSDB timestamp out of range: %v", timestamp)
+	}
+
+	metric.Timestamp = uint32(timestamp)
+	metric.Value = string(fields[3])
+
+	return metric, nil
+}
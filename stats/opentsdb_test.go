@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBuildMetricFromOpenTSDB(t *testing.T) {
+	datapoint := Datapoint{Value: []byte("put sys.cpu.user 1498887 42.5 host=web01 cpu=0"), Tags: map[string]string{"host": "header", "appname": "testaroo"}}
+	metric, err := BuildMetricFromOpenTSDB(datapoint)
+	if err != nil {
+		t.Errorf("failed to build metric from '%v': %v", string(datapoint.Value), err)
+	}
+	expected := Metric{
+		Path:      "sys.cpu.user",
+		Tags:      map[string]string{"host": "web01", "cpu": "0", "appname": "testaroo"},
+		Timestamp: 1498887,
+		Value:     "42.5",
+	}
+	if !reflect.DeepEqual(metric, expected) {
+		t.Errorf("invalid metric built:\nExp. %v\nGot: %v", expected, metric)
+	}
+
+	metric, err = BuildMetricFromOpenTSDB(Datapoint{Value: []byte("put sys.cpu.user 1498887000000 42")})
+	if err != nil || metric.Timestamp != 1498887000 {
+		t.Errorf("failed to build metric with a timestamp in milliseconds: %v, %v", metric, err)
+	}
+
+	reasons := map[string]string{
+		"sys.cpu.user 1498887 42":            "missing_command",
+		"put":                                "empty_path",
+		"put sys.cpu.user 1498887":           "missing_timestamp",
+		"put sys.cpu.user abc 42":            "invalid_timestamp",
+		"put sys.cpu.user -1 42":             "timestamp_out_of_range",
+		"put sys.cpu.user 1498887 42 host":   "invalid_tag",
+		"put sys.cpu.user 1498887 42 =web01": "invalid_tag",
+	}
+	for value, reason := range reasons {
+		if _, err := BuildMetricFromOpenTSDB(Datapoint{Value: []byte(value)}); err == nil || ErrorReason(err) != reason {
+			t.Errorf("building metric from an invalid OpenTSDB datapoint '%v' should fail with reason %v: %v", value, reason, err)
+		}
+	}
+
+	var parseError *ParseError
+	_, err = BuildMetricFromOpenTSDB(Datapoint{Value: []byte("put sys.cpu.user abc 42 host=web01"), Tags: map[string]string{"appname": "testaroo"}})
+	if !errors.As(err, &parseError) || parseError.Path != "sys.cpu.user" || parseError.Tags["appname"] != "testaroo" {
+		t.Errorf("the error should contain the path & tags of the datapoint: %#v", err)
+	}
+}
+
+func TestProcessOpenTSDB(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "by-tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}, {Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}}},
+			ComponentsNb: 3,
+		},
+		Format: FormatOpenTSDB,
+	}
+
+	lines := map[string]ExtractedMetric{
+		"put foo.aggreg.myapp.requests 1498887 1 host=web01":     {ExtractedMetric: "foo.aggreg.myapp", ApplicationName: "myapp", ApplicationType: "aggreg"},
+		"put sys.cpu.user 1498887 1 host=web01 appname=testaroo": {ExtractedMetric: "sys.cpu.user", ApplicationName: "testaroo", ApplicationType: "by-tag"},
+	}
+	for line, expected := range lines {
+		metrics, err := stats.BuildMetrics(Datapoint{Value: []byte(line)})
+		if err != nil || len(metrics) != 1 {
+			t.Fatalf("failed to build OpenTSDB metric from `%v`: %v", line, err)
+		}
+		if extractedMetric := stats.getMetric(logger, metrics[0].Path, metrics[0].Tags); !reflect.DeepEqual(extractedMetric, expected) {
+			t.Errorf("invalid extracted metric from `%v`:\nExp. %v\nGot: %v", line, expected, extractedMetric)
+		}
+	}
+}
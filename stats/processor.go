@@ -3,19 +3,38 @@ package stats
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/Shopify/sarama"
 	"github.com/criteo/graphite-writer-stats/prometheus"
 	"go.uber.org/zap"
 )
 
 // Stats is used to log messages & configuration
+// Format is the format of processed datapoints, the plaintext one if empty; TopicFormats overrides it per datapoint source.
+// InfluxTemplate builds the path of influx datapoints, DefaultPathTemplate if empty.
+// TopicLabel sets the source of datapoints (ex: kafka topic) as the topic label of metrics_path_total,
+// which must be registered with prometheus.SetMetricPathTopicLabel.
+// Report, if set, counts processed datapoints per application & rule, in addition to prometheus metrics.
+// FutureThreshold & PastThreshold are the largest accepted skews of datapoint timestamps from the wall-clock time, 0 to disable.
+// Backfill, if set, raises alerts for applications backfilling large shares of their datapoints.
+// The most frequent counter increments are accumulated in batch if set, see Batched.
 type Stats struct {
-	MetricMetadata MetricMetadata
+	MetricMetadata  MetricMetadata
+	Format          Format
+	TopicFormats    map[string]Format
+	InfluxTemplate  PathTemplate
+	TopicLabel      bool
+	Report          *Report
+	FutureThreshold time.Duration
+	PastThreshold   time.Duration
+	Backfill        *BackfillTracker
+	batch           *Batch
 }
 
-// The Metric structure only contains its path & tags; it doesn't store timestamp or value
+// The Metric structure contains its path & tags, its timestamp & its value as received
 type Metric struct {
 	Path      string
 	Tags      map[string]string
@@ -23,66 +42,234 @@ type Metric struct {
 	Value     string
 }
 
-// BuildMetricFromMessage is retrieving a Metric from a consumed message.
-func BuildMetricFromMessage(message *sarama.ConsumerMessage) (Metric, error) {
-	var timestamp uint64
+// Datapoint is an input-agnostic raw datapoint, as received by an input source.
+// Value is the raw datapoint, Tags are out-of-band tags (ex: kafka headers), Source is the name of the input (ex: kafka topic),
+// Timestamp is the reception time & Offset the position of the datapoint in its input.
+type Datapoint struct {
+	Value     []byte
+	Tags      map[string]string
+	Source    string
+	Timestamp time.Time
+	Offset    int64
+}
+
+// LineError is a datapoint line of a message which could not be processed
+type LineError struct {
+	Line []byte
+	Err  error
+}
+
+// MessageError reports all the datapoint lines of a message which could not be processed
+type MessageError struct {
+	Lines []LineError
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("%v invalid datapoint(s) in message, first one: %v", len(e.Lines), e.Lines[0].Err)
+}
+
+// BuildMetricFromDatapoint is retrieving a Metric from a received datapoint.
+func BuildMetricFromDatapoint(datapoint Datapoint) (Metric, error) {
 	var err error
 
 	metric := Metric{}
 	metric.Tags = make(map[string]string, 0)
 
 	// Path
-	index := 0
-	indexSpace := bytes.IndexByte(message.Value, ' ')
-	if indexSpace != -1 {
-		index = indexSpace
-	}
-
+	indexSpace := bytes.IndexByte(datapoint.Value, ' ')
 	if indexSpace == -1 {
-		return metric, errors.New("Invalid indexSapce while parsing metric name")
+		return metric, newParseError(reasonMissingSpace, "Missing space after metric name")
+	}
+	if indexSpace == 0 {
+		return metric, newParseError(reasonEmptyPath, "Empty metric name")
 	}
 
-	metric.Path = string(message.Value[:index])
+	for k, v := range datapoint.Tags {
+		metric.Tags[k] = v
+	}
 
-	for _, kv := range message.Headers {
-		metric.Tags[string(kv.Key)] = string(kv.Value)
+	metric.Path, err = SplitTaggedPath(string(datapoint.Value[:indexSpace]), metric.Tags)
+	if err != nil {
+		return metric, err
 	}
 
-	lastIndexSpace := bytes.LastIndexByte(message.Value, ' ')
-	if lastIndexSpace == -1 || lastIndexSpace == indexSpace {
-		return metric, errors.New("Invalid lastIndexSpace while parsing metric name")
+	lastIndexSpace := bytes.LastIndexByte(datapoint.Value, ' ')
+	if lastIndexSpace == indexSpace || lastIndexSpace == len(datapoint.Value)-1 {
+		return metric, newPathParseError(reasonMissingTimestamp, metric.Path, metric.Tags, "Missing timestamp after metric value")
 	}
 
-	timestamp, err = strconv.ParseUint(string(message.Value[lastIndexSpace+1:]), 10, 32)
+	// Value, checked by BuildMetrics as for every format
+	metric.Value = string(bytes.TrimSpace(datapoint.Value[indexSpace+1 : lastIndexSpace]))
+
+	// Timestamp
+	metric.Timestamp, err = parseTimestamp(metric, string(datapoint.Value[lastIndexSpace+1:]))
+
+	return metric, err
+}
+
+// parseTimestamp parses the timestamp in seconds of a metric, rejecting negative & too large ones as out of range.
+func parseTimestamp(metric Metric, field string) (uint32, error) {
+	timestamp, err := strconv.ParseUint(field, 10, 32)
 	if err != nil {
-		return metric, err
+		if _, intErr := strconv.ParseInt(field, 10, 64); intErr == nil || errors.Is(err, strconv.ErrRange) {
+			return 0, newPathParseError(reasonTimestampOutOfRange, metric.Path, metric.Tags, "Timestamp out of range: %v", field)
+		}
+		return 0, newPathParseError(reasonInvalidTimestamp, metric.Path, metric.Tags, "Invalid timestamp `%v`", field)
+	}
+	return uint32(timestamp), nil
+}
+
+// SplitTaggedPath returns the bare name of a graphite tagged series (name;tag1=value1;tag2=value2)
+// and stores its tags in the given tags map. Tags from the series name take precedence over existing ones.
+func SplitTaggedPath(taggedPath string, tags map[string]string) (string, error) {
+	index := strings.IndexByte(taggedPath, ';')
+	if index == -1 {
+		return taggedPath, nil
+	}
+
+	path := taggedPath[:index]
+	if len(path) == 0 {
+		return path, newParseError(reasonEmptyPath, "Empty name in tagged series")
 	}
 
-	metric.Timestamp = uint32(timestamp)
+	for _, tag := range strings.Split(taggedPath[index+1:], ";") {
+		indexEqual := strings.IndexByte(tag, '=')
+		if indexEqual <= 0 || indexEqual == len(tag)-1 {
+			return path, &ParseError{Reason: reasonInvalidTag, Err: fmt.Errorf("Invalid tag `%v` in tagged series", tag)}
+		}
+		tags[tag[:indexEqual]] = tag[indexEqual+1:]
+	}
 
-	return metric, nil
+	return path, nil
 }
 
-// Process a consumer kafka message (building metric & processing)
-func (stats *Stats) Process(logger *zap.Logger, message *sarama.ConsumerMessage) error {
-	prometheus.IncMetricProcessedEvents()
+// ProcessMessage processes every datapoint of a received message: every json document for the json format,
+// every newline separated datapoint otherwise.
+// Invalid datapoints do not stop the processing of the following ones, and are all reported in a MessageError.
+func (stats *Stats) ProcessMessage(logger *zap.Logger, message Datapoint) error {
+	var lineErrors []LineError
+	var lines [][]byte
 
-	metric, err := BuildMetricFromMessage(message)
+	format := stats.formatOf(message)
+	if format == FormatJSON || (format == FormatAuto && isJSONMessage(message.Value)) {
+		documents, err := splitJSONDocuments(message.Value)
+		if err != nil {
+			stats.CountError(err)
+			return &MessageError{Lines: []LineError{{Line: message.Value, Err: err}}}
+		}
+		lines = documents
+	} else {
+		lines = SplitLines(message.Value)
+	}
+
+	for _, line := range lines {
+		datapoint := message
+		datapoint.Value = line
+		if err := stats.Process(logger, datapoint); err != nil {
+			lineErrors = append(lineErrors, LineError{Line: line, Err: err})
+		}
+	}
+	prometheus.ObserveMessageLines(len(lines))
+
+	if len(lines) == 0 {
+		err := newParseError(reasonEmptyMessage, "Empty message")
+		stats.CountError(err)
+		lineErrors = append(lineErrors, LineError{Line: message.Value, Err: err})
+	}
+
+	if len(lineErrors) > 0 {
+		return &MessageError{Lines: lineErrors}
+	}
+	return nil
+}
+
+// SplitLines returns the non-empty lines of a message, without their line endings
+func SplitLines(value []byte) [][]byte {
+	var lines [][]byte
+	for len(value) > 0 {
+		line := value
+		if index := bytes.IndexByte(value, '\n'); index != -1 {
+			line, value = value[:index], value[index+1:]
+		} else {
+			value = nil
+		}
+
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Process a received datapoint (building metrics & processing)
+func (stats *Stats) Process(logger *zap.Logger, datapoint Datapoint) error {
+	metrics, err := stats.BuildMetrics(datapoint)
 	if err != nil {
-		prometheus.IncDataPointToMetricErrorCounter()
+		stats.CountError(err)
 		return err
 	}
 
-	extractedMetric := stats.getMetric(logger, metric.Path, metric.Tags)
+	for _, metric := range metrics {
+		if datapoint.Offset%1000 == 0 && metric.Timestamp != 0 {
+			prometheus.SetMetricLatestTimestamp(float64(metric.Timestamp))
+		}
+
+		stats.ProcessMetric(logger, metric, datapoint)
+	}
+
+	return nil
+}
+
+// ProcessMetric processes a metric built from the given received datapoint, for inputs decoding datapoints on their own
+func (stats *Stats) ProcessMetric(logger *zap.Logger, metric Metric, datapoint Datapoint) {
+	stats.incProcessed()
+
+	extractedMetric, err := stats.classify(metric.Path, metric.Tags)
+	if err != nil {
+		logClassificationError(logger, metric.Path, err)
+		stats.incError(err)
+	}
 	if ce := logger.Check(zap.DebugLevel, "metrics"); ce != nil {
 		ce.Write(zap.Any("metric", metric.Path))
 	}
 
-	if message.Offset%1000 == 0 && metric.Timestamp != 0 {
-		prometheus.SetMetricLatestTimestamp(float64(metric.Timestamp))
+	topic := ""
+	if stats.TopicLabel {
+		topic = datapoint.Source
+	}
+	stats.incPath(extractedMetric, topic)
+	for _, field := range extractedMetric.LabelFields {
+		if value, ok := extractedMetric.Fields[field]; ok {
+			prometheus.IncRuleFieldCounter(field, value, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+		}
 	}
+	if quality := valueQuality(metric.Value); quality != "" {
+		prometheus.IncMetricValueQualityCounter(quality, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+	}
+	now := time.Now()
+	stats.observeSkew(metric, datapoint, extractedMetric, now)
+	stats.observeLateness(logger, metric, datapoint, extractedMetric, now)
+	if stats.Report != nil {
+		stats.Report.add(extractedMetric)
+	}
+}
 
-	prometheus.IncMetricPathCounter(extractedMetric.ExtractedMetric, extractedMetric.ApplicationName, string(extractedMetric.ApplicationType))
+// CountError counts an invalid datapoint, for inputs decoding datapoints on their own
+func (stats *Stats) CountError(err error) {
+	stats.incProcessed()
+	stats.incError(err)
+	if stats.Report != nil {
+		stats.Report.addError(ErrorReason(err))
+	}
+}
 
-	return nil
+// incError increments metrics_error_total with the reason of the error & the application of the datapoint, if known
+func (stats *Stats) incError(err error) {
+	reason := ErrorReason(err)
+	application, applicationType := stats.errorApplication(err)
+	prometheus.IncDataPointToMetricErrorCounter(reason, application, applicationType)
+	if quality, ok := errorQualities[reason]; ok {
+		prometheus.IncMetricValueQualityCounter(quality, application, applicationType)
+	}
 }
@@ -1,21 +1,22 @@
 package stats
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 
-	"github.com/Shopify/sarama"
 	"go.uber.org/zap/zaptest"
 )
 
 func TestProcess(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 
-	aggregRule := Rule{"aggreg", []string{}, []string{"foo", "aggreg"}, 2}
-	anotheraggrRule := Rule{"anotheraggr", []string{}, []string{"foo", "anotheraggr"}, 2}
-	aggregAllRule := Rule{"aggreg-all", []string{}, []string{"foo", "aggreg-all"}, 2}
-	legacybarRule := Rule{"legacy-bar", []string{}, []string{"prometheus", "bar"}, 1}
-	startWithCriteoRule := Rule{"start-by-foo", []string{}, []string{"foo"}, 1}
-	startbyAppRule := Rule{"start-by-app", []string{}, []string{}, 0}
+	aggregRule := Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
+	anotheraggrRule := Rule{Name: "anotheraggr", UseTags: []string{}, Pattern: []string{"foo", "anotheraggr"}, ApplicationNamePosition: 2}
+	aggregAllRule := Rule{Name: "aggreg-all", UseTags: []string{}, Pattern: []string{"foo", "aggreg-all"}, ApplicationNamePosition: 2}
+	legacybarRule := Rule{Name: "legacy-bar", UseTags: []string{}, Pattern: []string{"prometheus", "bar"}, ApplicationNamePosition: 1}
+	startWithCriteoRule := Rule{Name: "start-by-foo", UseTags: []string{}, Pattern: []string{"foo"}, ApplicationNamePosition: 1}
+	startbyAppRule := Rule{Name: "start-by-app", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}
 	rulesTab := []Rule{aggregRule, anotheraggrRule, aggregAllRule, legacybarRule, startWithCriteoRule, startbyAppRule}
 
 	stats := Stats{MetricMetadata: MetricMetadata{
@@ -24,22 +25,168 @@ func TestProcess(t *testing.T) {
 	}}
 
 	metricDatapoint := []byte("foo.aggreg.cas.value 3.2 1498887")
-	sm := new(sarama.ConsumerMessage)
-	sm.Value = metricDatapoint
-	err := stats.Process(logger, sm)
+	datapoint := Datapoint{Value: metricDatapoint}
+	err := stats.Process(logger, datapoint)
 	if err != nil {
 		t.Errorf("failed to process '%v'", string(metricDatapoint))
 	}
 
-	sm.Value = nil
-	err = stats.Process(logger, sm)
+	datapoint.Value = nil
+	err = stats.Process(logger, datapoint)
 	if err == nil {
 		t.Errorf("process a nil metric should return an error.")
 	}
 
-	sm.Value = []byte("foo.498887")
-	err = stats.Process(logger, sm)
+	datapoint.Value = []byte("foo.498887")
+	err = stats.Process(logger, datapoint)
 	if err == nil {
-		t.Errorf("process a malformed metric should return an error: '%v'.", string(sm.Value))
+		t.Errorf("process a malformed metric should return an error: '%v'.", string(datapoint.Value))
+	}
+}
+
+func TestBuildMetricFromDatapoint(t *testing.T) {
+	datapoint := Datapoint{Value: []byte("foo.bar 42 1498887"), Tags: map[string]string{"appname": "testaroo"}}
+	metric, err := BuildMetricFromDatapoint(datapoint)
+	if err != nil {
+		t.Errorf("failed to build metric from '%v': %v", string(datapoint.Value), err)
+	}
+	if metric.Path != "foo.bar" || metric.Timestamp != 1498887 || metric.Tags["appname"] != "testaroo" {
+		t.Errorf("invalid metric built from '%v': %v", string(datapoint.Value), metric)
+	}
+}
+
+func TestBuildMetricFromTaggedSeries(t *testing.T) {
+	datapoint := Datapoint{Value: []byte("disk.used;datacenter=dc1;server=web01 42 1498887"), Tags: map[string]string{"server": "header", "appname": "testaroo"}}
+	metric, err := BuildMetricFromDatapoint(datapoint)
+	if err != nil {
+		t.Errorf("failed to build metric from '%v': %v", string(datapoint.Value), err)
+	}
+	expectedTags := map[string]string{"datacenter": "dc1", "server": "web01", "appname": "testaroo"}
+	if metric.Path != "disk.used" || !reflect.DeepEqual(metric.Tags, expectedTags) {
+		t.Errorf("invalid metric built from '%v': %v", string(datapoint.Value), metric)
+	}
+
+	for _, value := range []string{"disk.used;datacenter 42 1498887", "disk.used;=dc1 42 1498887", "disk.used;datacenter= 42 1498887", ";datacenter=dc1 42 1498887"} {
+		if _, err := BuildMetricFromDatapoint(Datapoint{Value: []byte(value)}); err == nil {
+			t.Errorf("building metric from an invalid tagged series should fail: '%v'", value)
+		}
+	}
+}
+
+func TestProcessTaggedSeries(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{MetricMetadata: MetricMetadata{
+		Rules:        Rules{Rules: []Rule{{Name: "by-tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}, {Name: "start-by-app", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+		ComponentsNb: 3,
+	}}
+
+	metric, err := BuildMetricFromDatapoint(Datapoint{Value: []byte("foo.bar;appname=testaroo 42 1498887")})
+	if err != nil {
+		t.Errorf("failed to build tagged metric: %v", err)
+	}
+	extractedMetric := stats.getMetric(logger, metric.Path, metric.Tags)
+	if extractedMetric.ApplicationName != "testaroo" || extractedMetric.ExtractedMetric != "foo.bar" {
+		t.Errorf("tag rule should match tagged series: %v", extractedMetric)
+	}
+}
+
+func TestProcessMessage(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	stats := Stats{MetricMetadata: MetricMetadata{
+		Rules:        Rules{Rules: []Rule{{Name: "start-by-app", UseTags: []string{}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+		ComponentsNb: 3,
+	}}
+
+	message := Datapoint{Value: []byte("foo.bar 1 1498887\r\nfoo.baz 2 1498887\n\nfoo.qux 3 1498887")}
+	if err := stats.ProcessMessage(logger, message); err != nil {
+		t.Errorf("failed to process multiple datapoints message: %v", err)
+	}
+
+	message = Datapoint{Value: []byte("foo.bar 1 1498887\nfoo.498887\nfoo.baz 2 1498887\nfoo.qux 3 abc\n")}
+	err := stats.ProcessMessage(logger, message)
+	messageError, ok := err.(*MessageError)
+	if !ok {
+		t.Fatalf("processing a message with invalid lines should return a MessageError: %v", err)
+	}
+	if len(messageError.Lines) != 2 || string(messageError.Lines[0].Line) != "foo.498887" || string(messageError.Lines[1].Line) != "foo.qux 3 abc" {
+		t.Errorf("invalid lines not reported: %v", messageError.Lines)
+	}
+
+	if err := stats.ProcessMessage(logger, Datapoint{Value: []byte("\n")}); err == nil {
+		t.Errorf("processing an empty message should return an error")
+	}
+}
+
+func TestBuildMetricErrorReasons(t *testing.T) {
+	reasons := map[string]string{
+		"foo.bar":                         "missing_space",
+		" 42 1498887":                     "empty_path",
+		";tag=value 42 1498887":           "empty_path",
+		"foo.bar;tag 42 1498887":          "invalid_tag",
+		"foo.bar 42":                      "missing_timestamp",
+		"foo.bar 42 ":                     "missing_timestamp",
+		"foo.bar 42 now":                  "invalid_timestamp",
+		"foo.bar 42 4294967296":           "timestamp_out_of_range",
+		"foo.bar 42 -1":                   "timestamp_out_of_range",
+		"foo.bar forty-two 1498887":       "non_numeric_value",
+		"foo.bar 42 43 1498887":           "non_numeric_value",
+		"foo.bar;app=x 0x2G 1498887":      "non_numeric_value",
+		"foo.bar 42 1498887.5":            "invalid_timestamp",
+		"foo.bar 42 99999999999999999999": "timestamp_out_of_range",
+	}
+
+	for line, reason := range reasons {
+		_, err := (&Stats{}).BuildMetrics(Datapoint{Value: []byte(line)})
+		if err == nil || ErrorReason(err) != reason {
+			t.Errorf("building a metric from '%v' should fail with reason %v, got: %v", line, reason, err)
+		}
+	}
+
+	if _, err := BuildMetricFromDatapoint(Datapoint{Value: []byte("foo.bar  42 1498887")}); err != nil {
+		t.Errorf("extra spaces around the value should be accepted: %v", err)
+	}
+}
+
+func TestErrorApplication(t *testing.T) {
+	stats := Stats{MetricMetadata: MetricMetadata{
+		Rules:        Rules{Rules: []Rule{{Name: "aggreg", Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}, {Name: "deep", Pattern: []string{"deep"}, ApplicationNamePosition: 5}}},
+		ComponentsNb: 3,
+	}}
+
+	applications := map[string][3]string{
+		"foo.aggreg.app1.x 42":      {"missing_timestamp", "app1", "aggreg"},
+		"foo.aggreg.app1.x one 42":  {"non_numeric_value", "app1", "aggreg"},
+		"foo.aggreg.app1.x 1 -1498": {"timestamp_out_of_range", "app1", "aggreg"},
+		"bar.x 42 never":            {"invalid_timestamp", "None", "None"},
+		"foo.aggreg":                {"missing_space", "None", "None"},
+		" 42 1498887":               {"empty_path", "None", "None"},
+	}
+	for line, expected := range applications {
+		_, err := stats.BuildMetrics(Datapoint{Value: []byte(line)})
+		application, applicationType := stats.errorApplication(err)
+		if ErrorReason(err) != expected[0] || application != expected[1] || applicationType != expected[2] {
+			t.Errorf("invalid error application of '%v': %v, %v, %v", line, ErrorReason(err), application, applicationType)
+		}
+	}
+
+	for _, err := range []error{newParseError(reasonEmptyMessage, "Empty message"), errors.New("not a ParseError")} {
+		if application, applicationType := stats.errorApplication(err); application != "None" || applicationType != "None" {
+			t.Errorf("the application of an error without path should be None, got: %v, %v", application, applicationType)
+		}
+	}
+
+	labels := map[string]string{"reason": "empty_message", "application": "None", "application_type": "None"}
+	before := gatheredValue(t, "metrics_error_total", labels)
+	stats.CountError(newParseError(reasonEmptyMessage, "Empty message"))
+	if count := gatheredValue(t, "metrics_error_total", labels) - before; count != 1 {
+		t.Errorf("an error without path should be counted with None labels, got %v", count)
+	}
+
+	_, err := stats.classify("deep.x", map[string]string{})
+	application, applicationType := stats.errorApplication(err)
+	if ErrorReason(err) != "application_position_out_of_range" || application != "None" || applicationType != "deep" {
+		t.Errorf("invalid error application of a too short path: %v, %v, %v", ErrorReason(err), application, applicationType)
 	}
 }
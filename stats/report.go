@@ -0,0 +1,128 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Report counts the processed datapoints per application & rule, ex: over the time window of a replay.
+// It is safe for concurrent use; Start & End only describe the reported window.
+type Report struct {
+	Start      time.Time
+	End        time.Time
+	mutex      sync.Mutex
+	datapoints uint64
+	entries    map[ReportEntry]uint64
+	errors     map[string]uint64
+}
+
+// ReportEntry is the number of datapoints of an application, matched by the given rule.
+// Application & Rule are "None" for datapoints which did not match any rule.
+type ReportEntry struct {
+	Application string `json:"application"`
+	Rule        string `json:"rule"`
+	Datapoints  uint64 `json:"datapoints"`
+}
+
+// reportDocument is the json representation of a Report
+type reportDocument struct {
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Datapoints   uint64            `json:"datapoints"`
+	Errors       map[string]uint64 `json:"errors"`
+	Applications []ReportEntry     `json:"applications"`
+}
+
+// NewReport initializes an empty Report of the given time window
+func NewReport(start time.Time, end time.Time) *Report {
+	return &Report{
+		Start:   start,
+		End:     end,
+		entries: make(map[ReportEntry]uint64),
+		errors:  make(map[string]uint64),
+	}
+}
+
+// add counts a datapoint of the given extracted metric
+func (report *Report) add(extractedMetric ExtractedMetric) {
+	key := ReportEntry{Application: extractedMetric.ApplicationName, Rule: extractedMetric.ApplicationType}
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.datapoints++
+	report.entries[key]++
+}
+
+// addError counts an invalid datapoint of the given reason.
+// Datapoints which could not be classified are only counted by add, with None labels.
+func (report *Report) addError(reason string) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.errors[reason]++
+}
+
+// Datapoints returns the number of valid datapoints
+func (report *Report) Datapoints() uint64 {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	return report.datapoints
+}
+
+// Entries returns the datapoints count per application & rule, the largest first
+func (report *Report) Entries() []ReportEntry {
+	report.mutex.Lock()
+	entries := make([]ReportEntry, 0, len(report.entries))
+	for entry, datapoints := range report.entries {
+		entry.Datapoints = datapoints
+		entries = append(entries, entry)
+	}
+	report.mutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Datapoints != entries[j].Datapoints {
+			return entries[i].Datapoints > entries[j].Datapoints
+		}
+		if entries[i].Application != entries[j].Application {
+			return entries[i].Application < entries[j].Application
+		}
+		return entries[i].Rule < entries[j].Rule
+	})
+	return entries
+}
+
+// WriteJSON writes the report as a json document, with the invalid datapoints count per reason
+func (report *Report) WriteJSON(w io.Writer) error {
+	document := reportDocument{Start: report.Start, End: report.End, Applications: report.Entries()}
+
+	report.mutex.Lock()
+	document.Datapoints = report.datapoints
+	document.Errors = make(map[string]uint64, len(report.errors))
+	for reason, count := range report.errors {
+		document.Errors[reason] = count
+	}
+	report.mutex.Unlock()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+// WriteCSV writes the report entries as csv, with an application,rule,datapoints header
+func (report *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"application", "rule", "datapoints"}); err != nil {
+		return err
+	}
+	for _, entry := range report.Entries() {
+		if err := writer.Write([]string{entry.Application, entry.Rule, strconv.FormatUint(entry.Datapoints, 10)}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
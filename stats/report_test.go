@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestReport(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	report := NewReport(time.Unix(1500000000, 0).UTC(), time.Unix(1500003600, 0).UTC())
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "aggreg", Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}}},
+			ComponentsNb: 3,
+		},
+		Report: report,
+	}
+
+	message := Datapoint{Value: []byte("foo.aggreg.app1.x 1 1500000000\nfoo.aggreg.app2.x 1 1500000000\nfoo.aggreg.app1.y 1 1500000000\nbar.x 1 1500000000\ninvalid")}
+	if err := stats.ProcessMessage(logger, message); err == nil {
+		t.Errorf("processing an invalid datapoint should return an error")
+	}
+
+	expected := []ReportEntry{
+		{Application: "app1", Rule: "aggreg", Datapoints: 2},
+		{Application: "None", Rule: "None", Datapoints: 1},
+		{Application: "app2", Rule: "aggreg", Datapoints: 1},
+	}
+	if entries := report.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("invalid report entries:\nExp. %v\nGot: %v", expected, entries)
+	}
+	if report.Datapoints() != 4 {
+		t.Errorf("4 datapoints should be reported, got %v", report.Datapoints())
+	}
+
+	var csv bytes.Buffer
+	if err := report.WriteCSV(&csv); err != nil {
+		t.Fatalf("failed to write csv report: %v", err)
+	}
+	expectedCSV := "application,rule,datapoints\napp1,aggreg,2\nNone,None,1\napp2,aggreg,1\n"
+	if csv.String() != expectedCSV {
+		t.Errorf("invalid csv report:\nExp. %q\nGot: %q", expectedCSV, csv.String())
+	}
+
+	var document bytes.Buffer
+	if err := report.WriteJSON(&document); err != nil {
+		t.Fatalf("failed to write json report: %v", err)
+	}
+	var decoded reportDocument
+	if err := json.Unmarshal(document.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid json report: %v", err)
+	}
+	if !decoded.Start.Equal(report.Start) || decoded.Datapoints != 4 || !reflect.DeepEqual(decoded.Errors, map[string]uint64{"missing_space": 1}) || !reflect.DeepEqual(decoded.Applications, expected) {
+		t.Errorf("invalid json report: %v", document.String())
+	}
+}
+
+func TestReportTotals(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	report := NewReport(time.Time{}, time.Time{})
+	stats := Stats{
+		MetricMetadata: MetricMetadata{
+			Rules:        Rules{Rules: []Rule{{Name: "aggreg", Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}, {Name: "deep", Pattern: []string{"deep"}, ApplicationNamePosition: 5}}},
+			ComponentsNb: 3,
+		},
+		Report: report,
+	}
+
+	lines := []string{
+		"foo.aggreg.app1.x 1 1500000000",
+		"foo.aggreg.app2.x 1 1500000000",
+		"bar.x 1 1500000000",
+		"deep.x 1 1500000000",
+		"foo.aggreg.app1.x abc 1500000000",
+		"foo.aggreg.app1.x 1",
+		"invalid",
+	}
+	stats.ProcessMessage(logger, Datapoint{Value: []byte(strings.Join(lines, "\n"))})
+
+	total := report.Datapoints()
+	for _, entry := range report.Entries() {
+		total -= entry.Datapoints
+	}
+	if total != 0 {
+		t.Errorf("the report entries should sum up to the reported datapoints, %v missing", total)
+	}
+
+	var decoded reportDocument
+	var document bytes.Buffer
+	if err := report.WriteJSON(&document); err != nil {
+		t.Fatalf("failed to write json report: %v", err)
+	}
+	if err := json.Unmarshal(document.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid json report: %v", err)
+	}
+	total = decoded.Datapoints
+	for _, count := range decoded.Errors {
+		total += count
+	}
+	if total != uint64(len(lines)) || decoded.Datapoints != 4 {
+		t.Errorf("every line should be reported once, as one of the 4 datapoints or an error: %v", document.String())
+	}
+}
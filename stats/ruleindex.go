@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// noRule is the rule index of the ruleIndex nodes without rule
+const noRule = math.MaxInt32
+
+// ruleIndex finds the first matching rule without scanning all rules:
+// pattern rules are indexed by a trie of their components, tag rules by tag.
+// Only the sequential rules (regex, composite & tag condition rules) preceding the best candidate are tried in order.
+type ruleIndex struct {
+	rules      []Rule
+	root       *ruleNode
+	tags       map[string]int
+	sequential []int
+	matchAll   int
+}
+
+// ruleNode is a pattern component of the trie, with literal & glob edges to the next components.
+// rule is the first rule whose pattern ends at this node, first the first rule of the node & its children.
+// Glob edges are grouped by their literal prefix, of one of the prefixLengths, to only try the ones a component starts with.
+type ruleNode struct {
+	rule          int
+	first         int
+	literals      map[string]*ruleNode
+	wildcards     map[string][]ruleEdge
+	prefixLengths []int
+}
+
+// ruleEdge is a glob edge of the trie
+type ruleEdge struct {
+	pattern string
+	node    *ruleNode
+}
+
+// newRuleIndex compiles the rules into a ruleIndex; regexes must have been compiled by CheckRules.
+func newRuleIndex(rules []Rule) *ruleIndex {
+	index := &ruleIndex{rules: rules, root: newRuleNode(), tags: make(map[string]int), matchAll: noRule}
+	for i, rule := range rules {
+		switch {
+		case len(rule.Regex) > 0 || rule.isConditional() || rule.isComposite():
+			index.sequential = append(index.sequential, i)
+		case len(rule.UseTags) > 0:
+			for _, tag := range rule.UseTags {
+				if _, ok := index.tags[tag]; !ok {
+					index.tags[tag] = i
+				}
+			}
+		case len(rule.Pattern) > 0:
+			index.root.add(rule.Pattern, i)
+		case index.matchAll == noRule:
+			index.matchAll = i
+		}
+	}
+	return index
+}
+
+func newRuleNode() *ruleNode {
+	return &ruleNode{rule: noRule, first: noRule}
+}
+
+// add indexes the rule of the given pattern below the node; braces are expanded to literal edges when possible.
+func (node *ruleNode) add(pattern []string, rule int) {
+	if rule < node.first {
+		node.first = rule
+	}
+	if len(pattern) == 0 {
+		if rule < node.rule {
+			node.rule = rule
+		}
+		return
+	}
+
+	for _, alternative := range expandBraces(pattern[0]) {
+		var child *ruleNode
+		if !strings.ContainsAny(alternative, globCharacters) {
+			if node.literals == nil {
+				node.literals = make(map[string]*ruleNode)
+			}
+			if child = node.literals[alternative]; child == nil {
+				child = newRuleNode()
+				node.literals[alternative] = child
+			}
+		} else {
+			prefix := alternative[:strings.IndexAny(alternative, globCharacters)]
+			for _, edge := range node.wildcards[prefix] {
+				if edge.pattern == alternative {
+					child = edge.node
+				}
+			}
+			if child == nil {
+				child = newRuleNode()
+				node.addWildcard(prefix, ruleEdge{alternative, child})
+			}
+		}
+		child.add(pattern[1:], rule)
+	}
+}
+
+// addWildcard adds a glob edge of the given literal prefix
+func (node *ruleNode) addWildcard(prefix string, edge ruleEdge) {
+	if node.wildcards == nil {
+		node.wildcards = make(map[string][]ruleEdge)
+	}
+	if _, ok := node.wildcards[prefix]; !ok {
+		i := sort.SearchInts(node.prefixLengths, len(prefix))
+		if i == len(node.prefixLengths) || node.prefixLengths[i] != len(prefix) {
+			node.prefixLengths = append(node.prefixLengths, 0)
+			copy(node.prefixLengths[i+1:], node.prefixLengths[i:])
+			node.prefixLengths[i] = len(prefix)
+		}
+	}
+	node.wildcards[prefix] = append(node.wildcards[prefix], edge)
+}
+
+// match returns the first rule matching the components below the node, if before best; best otherwise.
+func (node *ruleNode) match(components []string, best int) int {
+	if node.first >= best {
+		return best
+	}
+	if node.rule < best {
+		best = node.rule
+	}
+	if len(components) == 0 {
+		return best
+	}
+
+	if child, ok := node.literals[components[0]]; ok {
+		best = child.match(components[1:], best)
+	}
+	for _, prefixLength := range node.prefixLengths {
+		if prefixLength > len(components[0]) {
+			break
+		}
+		for _, edge := range node.wildcards[components[0][:prefixLength]] {
+			if edge.node.first < best && matchComponent(edge.pattern, components[0]) {
+				best = edge.node.match(components[1:], best)
+			}
+		}
+	}
+	return best
+}
+
+// match returns the index of the first rule matching the metric, noRule if none, and the submatches of its regex if any.
+func (index *ruleIndex) match(metricPath string, components []string, metricTags map[string]string) (int, []string) {
+	best := index.matchAll
+	for tag := range metricTags {
+		if rule, ok := index.tags[tag]; ok && rule < best {
+			best = rule
+		}
+	}
+	best = index.root.match(components, best)
+
+	for _, rule := range index.sequential {
+		if rule >= best {
+			break
+		}
+		if match, submatches := matchRule(metricPath, components, metricTags, index.rules[rule]); match {
+			return rule, submatches
+		}
+	}
+	return best, nil
+}
+
+// expandBraces returns the patterns matching like the given pattern component, without its balanced braces
+func expandBraces(pattern string) []string {
+	open := strings.IndexByte(pattern, '{')
+	if open == -1 {
+		return []string{pattern}
+	}
+	end, alternatives := braceAlternatives(pattern, open)
+	if end == -1 {
+		return []string{pattern}
+	}
+
+	var patterns []string
+	for _, alternative := range alternatives {
+		patterns = append(patterns, expandBraces(pattern[:open]+alternative+pattern[end+1:])...)
+	}
+	return patterns
+}
@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// benchmarkRules returns count rules: literal, glob & brace patterns, some tag rules, and a last match-all rule
+func benchmarkRules(count int) []Rule {
+	rules := make([]Rule, 0, count)
+	for i := 0; len(rules) < count-1; i++ {
+		switch i % 10 {
+		case 0:
+			rules = append(rules, Rule{Name: fmt.Sprintf("tag-%d", i), UseTags: []string{fmt.Sprintf("app%d", i)}})
+		case 1:
+			rules = append(rules, Rule{Name: fmt.Sprintf("glob-%d", i), Pattern: []string{fmt.Sprintf("svc%d-*", i), "{aggreg,agglo}"}, ApplicationNamePosition: 2})
+		default:
+			rules = append(rules, Rule{Name: fmt.Sprintf("team-%d", i), Pattern: []string{fmt.Sprintf("team%d", i), "aggreg"}, ApplicationNamePosition: 2})
+		}
+	}
+	return append(rules, Rule{Name: "start-by-app"})
+}
+
+// benchmarkPaths returns paths matching the first, middle & last pattern rules, the match-all rule, and a tagged path
+func benchmarkPaths(count int) []Metric {
+	return []Metric{
+		{Path: "team2.aggreg.myapp.requests"},
+		{Path: fmt.Sprintf("team%d.aggreg.myapp.requests", count/2+2)},
+		{Path: fmt.Sprintf("svc%d-eu.agglo.myapp.requests", (count-2)/10*10+1)},
+		{Path: "unknown.aggreg.myapp.requests"},
+		{Path: "team2.aggreg.myapp.requests", Tags: map[string]string{fmt.Sprintf("app%d", count/2/10*10): "tagged", "host": "web01"}},
+	}
+}
+
+func TestRuleIndex(t *testing.T) {
+	rules := Rules{Rules: append(benchmarkRules(100)[:99],
+		Rule{Name: "regex", Regex: `team(?P<app>[0-9]+)\.other\..*`},
+		Rule{Name: "unbalanced", Pattern: []string{"{team2", "*"}},
+		Rule{Name: "nested", Pattern: []string{"{x,y{1,[2-3]}}", "aggreg"}},
+		Rule{Name: "end", Pattern: []string{"team2", "*", "*", "last"}},
+		Rule{Name: "any", Pattern: []string{"*", "agglo"}},
+		Rule{Name: "conditional", Pattern: []string{"team2"}, TagConditions: []TagCondition{{Tag: "env", Equals: "prod"}}},
+		Rule{Name: "application-tag", ApplicationTag: "team"},
+		Rule{Name: "composite", UseTags: []string{"source"}, Pattern: []string{"team3", "*"}},
+	)}
+	if err := CheckRules(rules); err != nil {
+		t.Fatalf("failed to check rules: %v", err)
+	}
+	index := newRuleIndex(rules.Rules)
+
+	metrics := append(benchmarkPaths(100),
+		Metric{Path: "team42.other.x"},
+		Metric{Path: "team2.other.x"},
+		Metric{Path: "{team2.x"},
+		Metric{Path: "y3.aggreg.app"},
+		Metric{Path: "y1.aggreg.app"},
+		Metric{Path: "x.aggreg.app"},
+		Metric{Path: "svc11-.aggreg.app"},
+		Metric{Path: "svc11.aggreg.app"},
+		Metric{Path: "team2.x.y.last"},
+		Metric{Path: "team2"},
+		Metric{Path: "x.agglo.app"},
+		Metric{Path: "", Tags: map[string]string{"app0": "tagged"}},
+		Metric{Path: "team2.x", Tags: map[string]string{"env": "prod"}},
+		Metric{Path: "team3.x", Tags: map[string]string{"env": "prod", "team": "billing"}},
+		Metric{Path: "team3.x", Tags: map[string]string{"source": "relay"}},
+		Metric{Path: "team3", Tags: map[string]string{"source": "relay"}},
+	)
+	for _, metric := range metrics {
+		components := getComponents(metric.Path, 4)
+		expectedRule, expectedSubmatches := scanRules(metric.Path, components, metric.Tags, rules.Rules)
+		i, submatches := index.match(metric.Path, components, metric.Tags)
+		rule := Rule{}
+		if i != noRule {
+			rule = rules.Rules[i]
+		}
+		if !reflect.DeepEqual(rule, expectedRule) || !reflect.DeepEqual(submatches, expectedSubmatches) {
+			t.Errorf("Indexed rule of `%v` %v differs from the scanned one:\nExp. %v %v\nGot: %v %v", metric.Path, metric.Tags, expectedRule, expectedSubmatches, i, submatches)
+		}
+	}
+
+	if i, _ := newRuleIndex(rules.Rules[:1]).match("unknown.path", []string{"unknown", "path"}, nil); i != noRule {
+		t.Errorf("No rule should match, got %v", i)
+	}
+}
+
+func BenchmarkGetRule(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		rules := benchmarkRules(count)
+		metrics := benchmarkPaths(count)
+		components := make([][]string, len(metrics))
+		for i, metric := range metrics {
+			components[i] = getComponents(metric.Path, 3)
+		}
+
+		b.Run(fmt.Sprintf("scan-%d", count), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				metric := metrics[n%len(metrics)]
+				scanRules(metric.Path, components[n%len(metrics)], metric.Tags, rules)
+			}
+		})
+
+		index := newRuleIndex(rules)
+		b.Run(fmt.Sprintf("index-%d", count), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				metric := metrics[n%len(metrics)]
+				index.match(metric.Path, components[n%len(metrics)], metric.Tags)
+			}
+		})
+	}
+}
@@ -3,23 +3,42 @@ package stats
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 )
 
+// applicationGroup is the named capture group of rule regexes extracting the application name
+const applicationGroup = "app"
+
 // Rules is an array of Rule.
+// Rules loaded by GetRulesFromBytes are compiled into an index, other ones are scanned in order.
 type Rules struct {
 	Rules []Rule `json:"rules"`
+	index *ruleIndex
 }
 
 // Rule structure
 // Name will be used in prometheus metrics
-// UseTags: If present and not empty, rule will match if any tags in list is present in metric.
-// If not empty, pattern & applicationNamePosition will be ignored
+// UseTags: If present and not empty, rule will match if any tags in list is present in metric, and its value will be the application name.
+// If not empty, applicationNamePosition will be ignored; a composite rule with a pattern too must match both.
 // Pattern: Pattern to match the metric; If matching, the ApplicationNamePosition-nth will be used.
+// Pattern components are carbon globs: "*", "prefix*", "{a,b,c}" or "[0-9]", see matchComponent.
+// Regex: If not empty, rule will match if this regular expression matches the whole metric path, and its "app" named group
+// will be used as the application name, other named groups being extra fields. It is compiled by CheckRules,
+// an unchecked regex rule never matches. Exclusive with UseTags & Pattern.
+// LabelFields: Named groups of the regex exported as the field labels of metrics_rule_fields_total; other fields are not exported,
+// their values being unbounded.
+// TagConditions: If not empty, rule will only match if the metric tags satisfy all of them, whatever its kind.
+// ApplicationTag: If not empty, rule will only match if the metric has this tag, whose value will be used as the application name.
 type Rule struct {
-	Name                    string   `json:"name"`
-	UseTags                 []string `json:"use_tags"`
-	Pattern                 []string `json:"pattern"`
-	ApplicationNamePosition uint     `json:"applicationNamePosition"`
+	Name                    string         `json:"name"`
+	UseTags                 []string       `json:"use_tags"`
+	Pattern                 []string       `json:"pattern"`
+	ApplicationNamePosition uint           `json:"applicationNamePosition"`
+	Regex                   string         `json:"regex"`
+	LabelFields             []string       `json:"label_fields"`
+	TagConditions           []TagCondition `json:"tag_conditions"`
+	ApplicationTag          string         `json:"application_tag"`
+	regex                   *regexp.Regexp
 }
 
 // GetRulesFromBytes loads rules from json contents
@@ -32,10 +51,14 @@ func GetRulesFromBytes(jsonBytes []byte) (Rules, error) {
 	}
 
 	err = CheckRules(rules)
+	if err == nil {
+		rules.index = newRuleIndex(rules.Rules)
+	}
 	return rules, err
 }
 
 // CheckRules will return an error if no rule exists or invalid rule is found.
+// Regexes of the rules are compiled, anchored to the whole metric path, as well as the regexes of their tag conditions.
 func CheckRules(rules Rules) error {
 	if len(rules.Rules) <= 0 {
 		return fmt.Errorf("no rules defined")
@@ -46,10 +69,48 @@ func CheckRules(rules Rules) error {
 			return fmt.Errorf("Bad rule name `%v` at indice `%v`", rule.Name, i)
 		}
 
-		if len(rule.UseTags) > 0 && len(rule.Pattern) > 0 {
-			return fmt.Errorf("rule `%v` `%v` has tags & patterns defined but are mutually exclusive", rule.Name, i)
+		if len(rule.Regex) > 0 {
+			if len(rule.UseTags) > 0 || len(rule.Pattern) > 0 {
+				return fmt.Errorf("rule `%v` `%v` has a regex defined with tags or patterns but they are mutually exclusive", rule.Name, i)
+			}
+			regex, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+			if err != nil {
+				return fmt.Errorf("rule `%v` `%v` has an invalid regex: %v", rule.Name, i, err)
+			}
+			if subexpIndex(regex, applicationGroup) == -1 && len(rule.ApplicationTag) == 0 {
+				return fmt.Errorf("rule `%v` `%v` regex has no `%v` named group", rule.Name, i, applicationGroup)
+			}
+			for _, field := range rule.LabelFields {
+				if field == applicationGroup || subexpIndex(regex, field) == -1 {
+					return fmt.Errorf("rule `%v` `%v` label field `%v` is not an extra named group of its regex", rule.Name, i, field)
+				}
+			}
+			rules.Rules[i].regex = regex
+		} else if len(rule.LabelFields) > 0 {
+			return fmt.Errorf("rule `%v` `%v` has label fields without regex", rule.Name, i)
+		}
+
+		for j := range rule.TagConditions {
+			if err := rules.Rules[i].TagConditions[j].check(); err != nil {
+				return fmt.Errorf("rule `%v` `%v` %v", rule.Name, i, err)
+			}
 		}
 	}
 
 	return nil
 }
+
+// subexpIndex returns the index of the named group of the regex, -1 if none
+func subexpIndex(regex *regexp.Regexp, name string) int {
+	for i, subexpName := range regex.SubexpNames() {
+		if subexpName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isComposite reports whether the rule requires both one of its tags & its pattern
+func (rule *Rule) isComposite() bool {
+	return len(rule.UseTags) > 0 && len(rule.Pattern) > 0
+}
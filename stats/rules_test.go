@@ -68,13 +68,13 @@ func TestGetRules(t *testing.T) {
     }
   ]
 }`)
-	tagRule := Rule{"tag-rule", []string{"appname"}, []string{}, 0}
-	aggregRule := Rule{"aggreg", []string{}, []string{"foo", "aggreg"}, 2}
-	anotheraggrRule := Rule{"anotheraggr", []string{}, []string{"foo", "anotheraggr"}, 2}
-	aggregAllRule := Rule{"aggreg-all", []string{}, []string{"foo", "aggreg-all"}, 2}
-	legacybarRule := Rule{"legacy-bar", []string{}, []string{"prometheus", "bar"}, 1}
-	startWithCriteoRule := Rule{"start-by-foo", []string{}, []string{"foo"}, 1}
-	startbyAppRule := Rule{"start-by-app", []string{}, nil, 0}
+	tagRule := Rule{Name: "tag-rule", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}
+	aggregRule := Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
+	anotheraggrRule := Rule{Name: "anotheraggr", UseTags: []string{}, Pattern: []string{"foo", "anotheraggr"}, ApplicationNamePosition: 2}
+	aggregAllRule := Rule{Name: "aggreg-all", UseTags: []string{}, Pattern: []string{"foo", "aggreg-all"}, ApplicationNamePosition: 2}
+	legacybarRule := Rule{Name: "legacy-bar", UseTags: []string{}, Pattern: []string{"prometheus", "bar"}, ApplicationNamePosition: 1}
+	startWithCriteoRule := Rule{Name: "start-by-foo", UseTags: []string{}, Pattern: []string{"foo"}, ApplicationNamePosition: 1}
+	startbyAppRule := Rule{Name: "start-by-app", UseTags: []string{}, Pattern: nil, ApplicationNamePosition: 0}
 	rulesExpected := []Rule{tagRule, aggregRule, anotheraggrRule, aggregAllRule, legacybarRule, startWithCriteoRule, startbyAppRule}
 	rules, err := GetRulesFromBytes(jsonRules)
 
@@ -89,32 +89,31 @@ func TestGetRules(t *testing.T) {
 	}
 }
 func TestCheckRules(t *testing.T) {
-	// Name, UseTags, Pattern, ApplicationNamePosition
-	aggregRule := Rule{"aggreg", []string{}, []string{"foo", "aggreg"}, 2}
-	anotheraggrRule := Rule{"anotheraggr", []string{}, []string{"foo", "anotheraggr"}, 2}
-	aggregAllRule := Rule{"aggreg-all", []string{}, []string{"foo", "aggreg-all"}, 2}
-	legacybarRule := Rule{"legacy-bar", []string{}, []string{"prometheus", "bar"}, 1}
-	startWithCriteoRule := Rule{"start-by-foo", []string{}, []string{"foo"}, 1}
-	startbyAppRule := Rule{"start-by-app", []string{}, nil, 0}
+	aggregRule := Rule{Name: "aggreg", UseTags: []string{}, Pattern: []string{"foo", "aggreg"}, ApplicationNamePosition: 2}
+	anotheraggrRule := Rule{Name: "anotheraggr", UseTags: []string{}, Pattern: []string{"foo", "anotheraggr"}, ApplicationNamePosition: 2}
+	aggregAllRule := Rule{Name: "aggreg-all", UseTags: []string{}, Pattern: []string{"foo", "aggreg-all"}, ApplicationNamePosition: 2}
+	legacybarRule := Rule{Name: "legacy-bar", UseTags: []string{}, Pattern: []string{"prometheus", "bar"}, ApplicationNamePosition: 1}
+	startWithCriteoRule := Rule{Name: "start-by-foo", UseTags: []string{}, Pattern: []string{"foo"}, ApplicationNamePosition: 1}
+	startbyAppRule := Rule{Name: "start-by-app", UseTags: []string{}, Pattern: nil, ApplicationNamePosition: 0}
 	rules := Rules{Rules: []Rule{aggregRule, anotheraggrRule, aggregAllRule, legacybarRule, startWithCriteoRule, startbyAppRule}}
 	err := CheckRules(rules)
 	if err != nil {
 		t.Errorf("should not get the error: `%v`", err)
 	}
-	startbyAppRule = Rule{"", []string{}, nil, 0}
+	startbyAppRule = Rule{Name: "", UseTags: []string{}, Pattern: nil, ApplicationNamePosition: 0}
 	rules = Rules{Rules: []Rule{aggregRule, anotheraggrRule, aggregAllRule, legacybarRule, startWithCriteoRule, startbyAppRule}}
 	err = CheckRules(rules)
 	if err == nil {
 		t.Errorf("the rule should have a name: `%v`", err)
 	}
-	err = CheckRules(Rules{nil})
+	err = CheckRules(Rules{Rules: nil})
 	if err == nil {
 		t.Error("having a least one rule is mandatory")
 	}
 }
 
 func TestErrorRules(t *testing.T) {
-	rule := Rule{"rule1", []string{"foo"}, []string{"foo"}, 1}
+	rule := Rule{Name: "rule1", Regex: "(?P<app>foo)", Pattern: []string{"foo"}, ApplicationNamePosition: 1}
 
 	rules := Rules{Rules: []Rule{rule}}
 	err := CheckRules(rules)
@@ -122,3 +121,70 @@ func TestErrorRules(t *testing.T) {
 		t.Errorf("an error should happen when parsing rules: `%v`", rules)
 	}
 }
+
+func TestRegexRules(t *testing.T) {
+	rules, err := GetRulesFromBytes([]byte(`{"rules": [{"name": "svc", "regex": "svc-(?P<app>[a-z]+)_(?P<env>[a-z]+)\\..*"}]}`))
+	if err != nil {
+		t.Fatalf("failed to load regex rule: %v", err)
+	}
+	if rules.Rules[0].regex == nil || !rules.Rules[0].regex.MatchString("svc-foo_prod.requests") || rules.Rules[0].regex.MatchString("old.svc-foo_prod.requests") {
+		t.Errorf("regex rule should be compiled anchored to the whole path: %v", rules.Rules[0].regex)
+	}
+
+	invalidRules := []Rule{
+		{Name: "invalid", Regex: "svc-(?P<app>[a-z]+"},
+		{Name: "no-app", Regex: "svc-(?P<application>[a-z]+)"},
+		{Name: "with-pattern", Regex: "svc-(?P<app>[a-z]+)", Pattern: []string{"svc"}},
+		{Name: "with-tags", Regex: "svc-(?P<app>[a-z]+)", UseTags: []string{"appname"}},
+		{Name: "unknown-label", Regex: "svc-(?P<app>[a-z]+)_(?P<env>[a-z]+)", LabelFields: []string{"host"}},
+		{Name: "app-label", Regex: "svc-(?P<app>[a-z]+)_(?P<env>[a-z]+)", LabelFields: []string{"app"}},
+		{Name: "label-without-regex", Pattern: []string{"svc"}, LabelFields: []string{"env"}},
+	}
+	for _, rule := range invalidRules {
+		if err := CheckRules(Rules{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("rule `%v` should be invalid", rule.Name)
+		}
+	}
+}
+
+func TestTagConditionRules(t *testing.T) {
+	rules, err := GetRulesFromBytes([]byte(`{"rules": [{
+		"name": "prod-teams",
+		"tag_conditions": [{"tag": "env", "equals": "prod"}, {"tag": "team"}, {"tag": "application", "regex": "^svc-"}],
+		"application_tag": "team"
+	}]}`))
+	if err != nil {
+		t.Fatalf("failed to load tag condition rule: %v", err)
+	}
+	conditions := rules.Rules[0].TagConditions
+	if len(conditions) != 3 || conditions[0].Equals != "prod" || conditions[2].regex == nil || rules.Rules[0].ApplicationTag != "team" {
+		t.Errorf("invalid tag conditions loaded: %+v", rules.Rules[0])
+	}
+
+	invalidConditions := []TagCondition{
+		{Equals: "prod"},
+		{Tag: "env", Equals: "prod", Absent: true},
+		{Tag: "env", Regex: "^prod", In: []string{"prod"}},
+		{Tag: "env", Regex: "(prod"},
+	}
+	for _, condition := range invalidConditions {
+		if err := CheckRules(Rules{Rules: []Rule{{Name: "invalid", TagConditions: []TagCondition{condition}}}}); err == nil {
+			t.Errorf("tag condition %+v should be invalid", condition)
+		}
+	}
+
+	if err := CheckRules(Rules{Rules: []Rule{{Name: "regex-app-tag", Regex: `svc-.*`, ApplicationTag: "team"}}}); err != nil {
+		t.Errorf("a regex rule with an application tag should not need an app group: %v", err)
+	}
+}
+
+func TestCompositeRules(t *testing.T) {
+	rules, err := GetRulesFromBytes([]byte(`{"rules": [{"name": "relay", "use_tags": ["source"], "pattern": ["foo", "aggregated"]}]}`))
+	if err != nil || !rules.Rules[0].isComposite() {
+		t.Errorf("rules with both tags & patterns should be valid composite rules: %v", err)
+	}
+
+	if _, err := GetRulesFromBytes([]byte(`{"rules": [{"name": "by-tag", "use_tags": ["appname"]}, {"name": "aggreg", "pattern": ["foo", "aggregated"], "applicationNamePosition": 2}]}`)); err != nil {
+		t.Errorf("tag & pattern rules should still be valid: %v", err)
+	}
+}
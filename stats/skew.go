@@ -0,0 +1,33 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/criteo/graphite-writer-stats/prometheus"
+)
+
+// Time references of the timestamp skew, and directions of out of window timestamps
+const (
+	skewReferenceMessage = "message"
+	skewReferenceClock   = "clock"
+	directionFuture      = "future"
+	directionPast        = "past"
+)
+
+// observeSkew records the lag of the metric timestamp behind the timestamp of its datapoint (ex: kafka message timestamp)
+// & behind the wall-clock time, and counts timestamps beyond the FutureThreshold & PastThreshold of the wall-clock time.
+func (stats *Stats) observeSkew(metric Metric, datapoint Datapoint, extractedMetric ExtractedMetric, now time.Time) {
+	timestamp := time.Unix(int64(metric.Timestamp), 0)
+
+	if !datapoint.Timestamp.IsZero() {
+		stats.observeSkewSeconds(skewReferenceMessage, extractedMetric, datapoint.Timestamp.Sub(timestamp).Seconds())
+	}
+
+	lag := now.Sub(timestamp)
+	stats.observeSkewSeconds(skewReferenceClock, extractedMetric, lag.Seconds())
+	if stats.FutureThreshold > 0 && -lag > stats.FutureThreshold {
+		prometheus.IncTimestampOutOfWindow(directionFuture, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+	} else if stats.PastThreshold > 0 && lag > stats.PastThreshold {
+		prometheus.IncTimestampOutOfWindow(directionPast, extractedMetric.ApplicationName, extractedMetric.ApplicationType)
+	}
+}
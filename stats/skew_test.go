@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// gatheredValue returns the value of the counter or gauge, or the sample count of the histogram, with the given name & labels
+func gatheredValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := promclient.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matching := 0
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matching++
+				}
+			}
+			if matching != len(labels) {
+				continue
+			}
+			if metric.GetHistogram() != nil {
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			if metric.GetGauge() != nil {
+				return metric.GetGauge().GetValue()
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestObserveSkew(t *testing.T) {
+	stats := Stats{FutureThreshold: 10 * time.Minute, PastThreshold: 24 * time.Hour}
+	now := time.Unix(1500000000, 0)
+	extractedMetric := ExtractedMetric{ApplicationName: "skewed", ApplicationType: "skew-test"}
+	labels := func(key string, value string) map[string]string {
+		return map[string]string{key: value, "application": "skewed", "application_type": "skew-test"}
+	}
+
+	timestamps := []int64{1500000000, 1500000000 + 3600, 1500000000 - 2*86400, 1500000000 - 3600}
+	for _, timestamp := range timestamps {
+		stats.observeSkew(Metric{Timestamp: uint32(timestamp)}, Datapoint{}, extractedMetric, now)
+	}
+	stats.observeSkew(Metric{Timestamp: 1500000000}, Datapoint{Timestamp: now}, extractedMetric, now)
+
+	if count := gatheredValue(t, "metrics_timestamp_out_of_window_total", labels("direction", "future")); count != 1 {
+		t.Errorf("1 datapoint should be in the future, got %v", count)
+	}
+	if count := gatheredValue(t, "metrics_timestamp_out_of_window_total", labels("direction", "past")); count != 1 {
+		t.Errorf("1 datapoint should be in the past, got %v", count)
+	}
+	if count := gatheredValue(t, "metrics_timestamp_skew_seconds", labels("reference", "clock")); count != 5 {
+		t.Errorf("5 clock skews should be observed, got %v", count)
+	}
+	if count := gatheredValue(t, "metrics_timestamp_skew_seconds", labels("reference", "message")); count != 1 {
+		t.Errorf("1 message skew should be observed, got %v", count)
+	}
+}
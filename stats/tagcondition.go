@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// TagCondition is a condition on the value of a tag of the metric, for a rule to match.
+// At most one of Equals, Regex, In & Absent is set: the tag value must be equal to Equals, match the Regex,
+// be one of In, or the tag must be absent. Without any of them, the tag must be present.
+type TagCondition struct {
+	Tag    string   `json:"tag"`
+	Equals string   `json:"equals"`
+	Regex  string   `json:"regex"`
+	In     []string `json:"in"`
+	Absent bool     `json:"absent"`
+	regex  *regexp.Regexp
+}
+
+// check returns an error if the condition is invalid, and compiles its regex
+func (condition *TagCondition) check() error {
+	if len(condition.Tag) <= 0 {
+		return fmt.Errorf("tag condition without tag")
+	}
+
+	operators := 0
+	for _, set := range []bool{len(condition.Equals) > 0, len(condition.Regex) > 0, len(condition.In) > 0, condition.Absent} {
+		if set {
+			operators++
+		}
+	}
+	if operators > 1 {
+		return fmt.Errorf("tag condition on `%v` has several of equals, regex, in & absent defined but they are mutually exclusive", condition.Tag)
+	}
+
+	if len(condition.Regex) > 0 {
+		regex, err := regexp.Compile(condition.Regex)
+		if err != nil {
+			return fmt.Errorf("tag condition on `%v` has an invalid regex: %v", condition.Tag, err)
+		}
+		condition.regex = regex
+	}
+	return nil
+}
+
+// match reports whether the tags satisfy the condition; an unchecked regex condition never matches.
+func (condition *TagCondition) match(tags map[string]string) bool {
+	value, present := tags[condition.Tag]
+	switch {
+	case condition.Absent:
+		return !present
+	case !present:
+		return false
+	case len(condition.Equals) > 0:
+		return value == condition.Equals
+	case len(condition.Regex) > 0:
+		return condition.regex != nil && condition.regex.MatchString(value)
+	case len(condition.In) > 0:
+		for _, accepted := range condition.In {
+			if value == accepted {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchTagConditions reports whether the tags satisfy all the tag conditions of the rule, and include its application tag if any
+func matchTagConditions(tags map[string]string, rule Rule) bool {
+	if len(rule.ApplicationTag) > 0 {
+		if _, present := tags[rule.ApplicationTag]; !present {
+			return false
+		}
+	}
+	for i := range rule.TagConditions {
+		if !rule.TagConditions[i].match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// isConditional reports whether the rule has conditions on tag values, or requires its application tag
+func (rule *Rule) isConditional() bool {
+	return len(rule.TagConditions) > 0 || len(rule.ApplicationTag) > 0
+}
@@ -0,0 +1,52 @@
+package stats
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Quality issues of datapoint values, labelling metrics_value_quality_total
+const (
+	qualityNaN        = "nan"
+	qualityInf        = "inf"
+	qualityNonNumeric = "non_numeric"
+	qualityEmpty      = "empty"
+)
+
+// errorQualities maps the reasons of datapoints rejected for their value to the value quality issue
+var errorQualities = map[string]string{
+	reasonNonNumericValue:  qualityNonNumeric,
+	reasonEmptyValue:       qualityEmpty,
+	reasonJSONInvalidValue: qualityNonNumeric,
+}
+
+// checkValue rejects a metric of an empty or non numeric value; NaN & infinite values are accepted.
+func checkValue(metric Metric) error {
+	switch valueQuality(metric.Value) {
+	case qualityEmpty:
+		return newPathParseError(reasonEmptyValue, metric.Path, metric.Tags, "Empty value")
+	case qualityNonNumeric:
+		return newPathParseError(reasonNonNumericValue, metric.Path, metric.Tags, "Non numeric value `%v`", metric.Value)
+	}
+	return nil
+}
+
+// valueQuality returns the quality issue of a datapoint value: nan, inf, non_numeric or empty; or "" if the value is a finite number.
+// Values too large for a float64 are infinite.
+func valueQuality(value string) string {
+	if value == "" {
+		return qualityEmpty
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	switch {
+	case err != nil && !errors.Is(err, strconv.ErrRange):
+		return qualityNonNumeric
+	case math.IsNaN(number):
+		return qualityNaN
+	case math.IsInf(number, 0):
+		return qualityInf
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestValueQuality(t *testing.T) {
+	qualities := map[string]string{
+		"42":        "",
+		"-3.2e-5":   "",
+		"NaN":       "nan",
+		"nan":       "nan",
+		"Inf":       "inf",
+		"-Infinity": "inf",
+		"1e400":     "inf",
+		"forty-two": "non_numeric",
+		"0x":        "non_numeric",
+		"":          "empty",
+	}
+
+	for value, expected := range qualities {
+		if quality := valueQuality(value); quality != expected {
+			t.Errorf("invalid quality of value '%v': %v != %v", value, quality, expected)
+		}
+	}
+}
+
+func TestBuildMetricValue(t *testing.T) {
+	values := map[string]string{
+		"foo.bar 42 1498887":   "42",
+		"foo.bar  NaN 1498887": "NaN",
+		"foo.bar -Inf 1498887": "-Inf",
+	}
+	for line, expected := range values {
+		metric, err := BuildMetricFromDatapoint(Datapoint{Value: []byte(line)})
+		if err != nil || metric.Value != expected {
+			t.Errorf("invalid value built from '%v': %v, %v", line, metric.Value, err)
+		}
+	}
+
+	if _, err := (&Stats{}).BuildMetrics(Datapoint{Value: []byte("foo.bar  1498887")}); ErrorReason(err) != "empty_value" {
+		t.Errorf("building a metric without value should fail with reason empty_value, got: %v", err)
+	}
+}
+
+func TestRejectValueAllFormats(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	stats := Stats{MetricMetadata: MetricMetadata{
+		Rules:        Rules{Rules: []Rule{{Name: "by-tag", UseTags: []string{"appname"}, Pattern: []string{}, ApplicationNamePosition: 0}}},
+		ComponentsNb: 3,
+	}}
+
+	datapoints := map[Format][2]string{
+		FormatPlain:    {"foo.bar;appname=quality-plain abc 1498887", "foo.bar;appname=quality-plain  1498887"},
+		FormatCarbon2:  {"appname=quality-carbon2 what=x  abc 1498887", ""},
+		FormatOpenTSDB: {"put foo.bar 1498887 abc appname=quality-opentsdb", ""},
+		FormatJSON:     {`{"path": "foo.bar;appname=quality-json", "value": "abc", "timestamp": 1498887}`, ""},
+		FormatInflux:   {"foo,appname=quality-influx value=abc 1498887000000000000", "foo,appname=quality-influx value= 1498887000000000000"},
+	}
+	// carbon 2.0 & OpenTSDB values can't be empty, being whitespace separated fields
+	for format, lines := range datapoints {
+		stats.Format = format
+		application := "quality-" + string(format)
+		for i, quality := range []string{"non_numeric", "empty"} {
+			if lines[i] == "" {
+				continue
+			}
+			labels := map[string]string{"quality": quality, "application": application, "application_type": "by-tag"}
+			before := gatheredValue(t, "metrics_value_quality_total", labels)
+			if err := stats.Process(logger, Datapoint{Value: []byte(lines[i])}); err == nil {
+				t.Errorf("%v: a %v value should be rejected: `%v`", format, quality, lines[i])
+			}
+			if gatheredValue(t, "metrics_value_quality_total", labels)-before != 1 {
+				t.Errorf("%v: the %v value of `%v` should be counted once for %v", format, quality, lines[i], application)
+			}
+		}
+	}
+}